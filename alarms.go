@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+type Alarm struct {
+	Trigger, Property, Regex, For string
+}
+
+// String returns the alarm in the form of an alarm argument.
+func (a Alarm) String() string {
+	if a.Property == "" {
+		return a.Trigger
+	}
+	if a.For != "" {
+		return a.Trigger + "=" + a.Property + "=" + a.Regex + "=" + a.For
+	}
+	return a.Trigger + "=" + a.Property + "=" + a.Regex
+}
+
+// alarm is a reminder added to events, relative to their start.
+type alarm struct {
+	// trigger is the offset from the start of the event as it was given, eg
+	// -15m.
+	trigger string
+	offset  time.Duration
+	// matcher limits the alarm to matching events, if set.
+	matcher eventMatcher
+}
+
+func (a alarm) Alarm() Alarm {
+	o := Alarm{
+		Trigger: a.trigger,
+	}
+	if a.matcher != nil {
+		m := a.matcher.Matcher()
+		o.Property, o.Regex, o.For = m.Property, m.Regex, m.For
+	}
+	return o
+}
+
+type alarms []alarm
+
+var alarmOffset = regexp.MustCompile(`^([+-]?)(?:(\d+)w)?(?:(\d+)d)?(?:(\d+)h)?(?:(\d+)m)?$`)
+
+// parseAlarms parses alarm arguments in the form <offset>[=<matcher>], where
+// matcher is as for parseMatcher, empty arguments are ignored. Time based
+// pseudo-properties are evaluated in loc.
+func parseAlarms(as []string, loc *time.Location) (alarms, error) {
+	alarms := make(alarms, 0, len(as))
+	for i, a := range as {
+		if a == "" {
+			// The form always sends an empty alarm to add another.
+			continue
+		}
+		trigger, matchOpt, hasMatcher := strings.Cut(a, "=")
+		offset, ok := parseAlarmOffset(trigger)
+		if !ok {
+			return nil, fmt.Errorf("invalid alarm parameter %q at index %d, should be <offset>[=<FIELD>=<regexp>] with an offset like -15m, -1h30m, or -1d", a, i)
+		}
+		alarm := alarm{
+			trigger: trigger,
+			offset:  offset,
+		}
+		if hasMatcher {
+			var err error
+			alarm.matcher, err = parseMatcher(matchOpt, i, loc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		alarms = append(alarms, alarm)
+	}
+	return alarms, nil
+}
+
+// parseAlarmOffset parses an offset from the start of an event made of weeks,
+// days, hours, and minutes, eg -1d or -1h30m.
+func parseAlarmOffset(s string) (time.Duration, bool) {
+	parts := alarmOffset.FindStringSubmatch(s)
+	if parts == nil || strings.TrimLeft(s, "+-") == "" {
+		return 0, false
+	}
+	var offset time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute} {
+		if parts[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(parts[i+2])
+		if err != nil {
+			return 0, false
+		}
+		offset += time.Duration(n) * unit
+	}
+	if parts[1] == "-" {
+		offset = -offset
+	}
+	return offset, true
+}
+
+// matching returns the alarms that apply to event.
+func (a alarms) matching(event *ics.VEvent) alarms {
+	var matching alarms
+	for _, alarm := range a {
+		if alarm.matcher == nil || alarm.matcher.matches(event) {
+			matching = append(matching, alarm)
+		}
+	}
+	return matching
+}
+
+// addAlarms adds a display alarm to event for each of alarms, described by the
+// event's summary. Existing alarms are removed first if strip is true.
+func addAlarms(event *ics.VEvent, alarms alarms, strip bool) {
+	if strip {
+		event.Components = slices.DeleteFunc(event.Components, func(component ics.Component) bool {
+			_, ok := component.(*ics.VAlarm)
+			return ok
+		})
+	}
+
+	description := "Reminder"
+	if summary := event.GetProperty(ics.ComponentPropertySummary); summary != nil && summary.Value != "" {
+		description = summary.Value
+	}
+	for _, a := range alarms {
+		valarm := event.AddAlarm()
+		valarm.SetAction(ics.ActionDisplay)
+		valarm.SetTrigger(icalDuration(a.offset))
+		valarm.SetProperty(ics.ComponentPropertyDescription, description)
+	}
+}
+
+// icalDuration formats d as an iCal duration, eg -PT15M or -P1D.
+func icalDuration(d time.Duration) string {
+	var b strings.Builder
+	if d < 0 {
+		b.WriteString("-")
+		d = -d
+	}
+	b.WriteString("P")
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	minutes := (d - hours*time.Hour) / time.Minute
+	if days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+	}
+	if days > 0 && hours == 0 && minutes == 0 {
+		return b.String()
+	}
+	b.WriteString("T")
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes > 0 || hours == 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	return b.String()
+}
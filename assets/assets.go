@@ -20,8 +20,10 @@ var (
 	}
 )
 
-func Templates() *template.Template {
-	return template.Must(template.New("_all").Funcs(funcs).ParseFS(templates, "html/*.html"))
+// Templates parses the HTML templates. The server must provide the extra
+// function "encodeCache".
+func Templates(extra template.FuncMap) *template.Template {
+	return template.Must(template.New("_all").Funcs(funcs).Funcs(extra).ParseFS(templates, "html/*.html"))
 }
 
 func dict(kv ...any) (map[string]any, error) {
@@ -1,8 +1,10 @@
 htmx.config.selfRequestsOnly = true;
 htmx.config.includeIndicatorStyles = false;
 
-function argBuilder(arg, property, operator, value) {
+function argBuilder(arg, property, operator, value, forValue) {
     return function() {
+        // only a property's parameter can be matched for some of its values
+        forValue.hidden = !property.value.includes(";");
         if (value.value == "") {
             arg.removeAttribute("name");
             arg.value="";
@@ -11,6 +13,9 @@ function argBuilder(arg, property, operator, value) {
 
         arg.name = operator.value;
         arg.value = property.value + "=" + value.value;
+        if (!forValue.hidden && forValue.value != "") {
+            arg.value += "=" + forValue.value;
+        }
     };
 }
 
@@ -23,7 +28,8 @@ function registerArgBuilders() {
         let property = matchers[i].parentElement.querySelector(".matcher-property");
         let operator = matchers[i].parentElement.querySelector(".matcher-operator");
         let value = matchers[i].parentElement.querySelector(".matcher-value");
-        let builder = argBuilder(arg, property, operator, value);
+        let forValue = matchers[i].parentElement.querySelector(".matcher-for");
+        let builder = argBuilder(arg, property, operator, value, forValue);
 
         var lastTimeout = undefined;
         let builderAndSubmit = function() {
@@ -41,6 +47,71 @@ function registerArgBuilders() {
     }
 }
 
+function rewriteArgBuilder(arg, property, value, replacement) {
+    return function() {
+        if (value.value == "") {
+            arg.removeAttribute("name");
+            arg.value="";
+            return;
+        }
+
+        arg.name = "rw";
+        arg.value = property.value + "=" + value.value + "=" + replacement.value;
+    };
+}
+
+function registerRewriteArgBuilders() {
+    let rewrites = document.getElementsByClassName("rewrite");
+    for (let i = 0; i < rewrites.length; i++) {
+        if (rewrites[i].hasAttribute("data-arg-builder-registered")) continue;
+
+        let arg = rewrites[i].parentElement.querySelector(".rewrite-arg");
+        let property = rewrites[i].parentElement.querySelector(".rewrite-property");
+        let value = rewrites[i].parentElement.querySelector(".rewrite-value");
+        let replacement = rewrites[i].parentElement.querySelector(".rewrite-replacement");
+        let builder = rewriteArgBuilder(arg, property, value, replacement);
+
+        var lastTimeout = undefined;
+        let builderAndSubmit = function() {
+            builder();
+            if (typeof lastTimeout !== undefined) clearTimeout(lastTimeout);
+            lastTimeout = setTimeout(function() {
+                document.getElementById("trigger-submit").dispatchEvent(new Event("input"))
+            }, 1000);
+        }
+        rewrites[i].addEventListener("input", builderAndSubmit);
+        builder();
+
+        rewrites[i].setAttribute("data-arg-builder-registered", "");
+    }
+}
+
+// addEmptyAlarm adds an empty alarm input after the last one once it is filled,
+// so that there is always somewhere to add another alarm.
+function addEmptyAlarm() {
+    let alarms = document.getElementsByClassName("alarm-option");
+    let last = alarms[alarms.length - 1];
+    if (last.value == "") return;
+
+    let empty = last.cloneNode(false);
+    empty.removeAttribute("value");
+    empty.removeAttribute("data-submit-registered");
+    empty.removeAttribute("data-alarm-registered");
+    empty.value = "";
+    last.after(empty);
+    registerAlarmOptions();
+}
+
+function registerAlarmOptions() {
+    let alarms = document.getElementsByClassName("alarm-option");
+    for (let i = 0; i < alarms.length; i++) {
+        if (alarms[i].hasAttribute("data-alarm-registered")) continue;
+        alarms[i].addEventListener("input", addEmptyAlarm);
+        alarms[i].setAttribute("data-alarm-registered", "");
+    }
+    registerSubmitByClass("alarm-option", 1000);
+}
+
 function registerCopyButton() {
     let button = document.getElementById("url-copy");
     if (button == null) return;
@@ -56,6 +127,32 @@ function registerCopyButton() {
     button.setAttribute("data-url-copy-registered", "");
 }
 
+function registerDownloadButton() {
+    let button = document.getElementById("url-download");
+    if (button == null) return;
+    if (button.hasAttribute("data-url-download-registered")) return;
+    button.addEventListener("click", function() {
+        // The URL box holds a webcal URL for calendar clients, fetch the same
+        // calendar from this server as CSV.
+        let url = new URL(document.getElementById("url-box").value.replace(/^webcal:/, window.location.protocol));
+        url.searchParams.set("fmt", "csv");
+
+        fetch(url, {headers: {"Accept": "text/csv"}})
+            .then(function(response) {
+                if (!response.ok) throw new Error(response.statusText);
+                return response.blob();
+            })
+            .then(function(blob) {
+                let link = document.createElement("a");
+                link.href = URL.createObjectURL(blob);
+                link.download = "calendar.csv";
+                link.click();
+                setTimeout(function() { URL.revokeObjectURL(link.href); }, 1000);
+            });
+    })
+    button.setAttribute("data-url-download-registered", "");
+}
+
 function registerSubmitById(id, timeout) {
     elem = document.getElementById(id, timeout);
     if (elem.hasAttribute("data-submit-registered")) return;
@@ -69,6 +166,21 @@ function registerSubmitById(id, timeout) {
     elem.setAttribute("data-submit-registered", "");
 }
 
+function registerSubmitByClass(className, timeout) {
+    let elems = document.getElementsByClassName(className);
+    for (let i = 0; i < elems.length; i++) {
+        if (elems[i].hasAttribute("data-submit-registered")) continue;
+        var lastTimeout = undefined;
+        elems[i].addEventListener("input", function() {
+            if (typeof lastTimeout !== undefined) clearTimeout(lastTimeout);
+            lastTimeout = setTimeout(function() {
+                document.getElementById("trigger-submit").dispatchEvent(new Event("input"));
+            }, timeout);
+        });
+        elems[i].setAttribute("data-submit-registered", "");
+    }
+}
+
 window.onload = function() {
     document.getElementById("config-form").addEventListener("submit", function(event) {
             // prevent form submission, only HTMX allowed
@@ -79,10 +191,24 @@ window.onload = function() {
 
     document.body.addEventListener("htmx:afterSettle", function() {
         registerCopyButton();
+        registerDownloadButton();
         registerArgBuilders();
+        registerRewriteArgBuilders();
+        registerSubmitByClass("input-url", 1000);
+        registerSubmitByClass("source-option", 1000);
         registerSubmitById("date-pick-year", 1000);
         registerSubmitById("date-pick-month", 0);
     });
 
     registerArgBuilders();
+    registerRewriteArgBuilders();
+    registerSubmitByClass("input-url", 1000);
+    registerSubmitByClass("source-option", 1000);
+    registerSubmitByClass("query-option", 1000);
+    registerSubmitByClass("window-option", 1000);
+    registerSubmitByClass("privacy-option", 1000);
+    registerAlarmOptions();
+    registerSubmitByClass("csv-option", 1000);
+    registerSubmitByClass("format-option", 0);
+    registerSubmitByClass("feed-option", 1000);
 };
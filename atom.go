@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// defaultFeedLimit is the number of upcoming events in a feed if there is no
+// limit argument.
+const defaultFeedLimit = 10
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated string    `xml:"updated"`
+	Link    *atomLink `xml:"link,omitempty"`
+	Summary string    `xml:"summary"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+// atom returns an Atom feed of the next limit events in calendar that haven't
+// ended by now, which must be sorted by start time. Times in entries are
+// described in loc.
+func atom(calendar *ics.Calendar, sources []source, limit int, now time.Time, loc *time.Location) atomFeed {
+	feed := atomFeed{
+		ID:     "urn:webcal-proxy:feed:" + sourcesID(sources),
+		Title:  "webcal-proxy",
+		Author: atomPerson{Name: "webcal-proxy"},
+	}
+	for _, property := range calendar.CalendarProperties {
+		if property.IANAToken == "X-WR-CALNAME" && property.Value != "" {
+			feed.Title = property.Value
+		}
+	}
+
+	var updated time.Time
+	for _, event := range calendar.Events() {
+		if len(feed.Entries) >= limit {
+			break
+		}
+		start, err := event.GetStartAt()
+		if err != nil {
+			continue
+		}
+		end, err := event.GetEndAt()
+		if err != nil || end.Before(start) {
+			end = start
+		}
+		if !end.After(now) && !start.Equal(now) {
+			continue
+		}
+
+		entryUpdated := eventUpdated(event, now)
+		if entryUpdated.After(updated) {
+			updated = entryUpdated
+		}
+
+		entry := atomEntry{
+			ID:      eventURN(event),
+			Title:   propertyValue(event, ics.ComponentPropertySummary),
+			Updated: entryUpdated.UTC().Format(time.RFC3339),
+			Summary: eventDescription(event, start, loc),
+		}
+		if link := propertyValue(event, ics.ComponentPropertyUrl); link != "" {
+			entry.Link = &atomLink{Href: link}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	if updated.IsZero() {
+		updated = now
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed
+}
+
+// eventURN returns an ID for event that is stable across requests, each
+// occurrence of a recurring event has its own ID.
+func eventURN(event *ics.VEvent) string {
+	id := "urn:webcal-proxy:event:" + url.PathEscape(event.Id())
+	if recurrenceID := event.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId)); recurrenceID != nil {
+		id += ":" + url.PathEscape(recurrenceID.Value)
+	}
+	return id
+}
+
+// eventUpdated returns when event was last modified, or when its iCal object
+// was created if that isn't known, or now if neither are.
+func eventUpdated(event *ics.VEvent, now time.Time) time.Time {
+	for _, property := range []ics.ComponentProperty{ics.ComponentPropertyLastModified, ics.ComponentPropertyDtstamp} {
+		p := event.GetProperty(property)
+		if p == nil {
+			continue
+		}
+		times, err := parseTimes(*p)
+		if err == nil && len(times) == 1 {
+			return times[0]
+		}
+	}
+	return now
+}
+
+// eventDescription describes when and where event is, followed by its
+// description.
+func eventDescription(event *ics.VEvent, start time.Time, loc *time.Location) string {
+	lines := []string{start.In(loc).Format("Mon 2 Jan 2006 15:04 MST")}
+	if dtStart := event.GetProperty(ics.ComponentPropertyDtStart); dtStart != nil && isDate(dtStart.BaseProperty) {
+		lines[0] = start.Format("Mon 2 Jan 2006")
+	}
+	if location := propertyValue(event, ics.ComponentPropertyLocation); location != "" {
+		lines = append(lines, "at "+location)
+	}
+	if description := propertyValue(event, ics.ComponentPropertyDescription); description != "" {
+		lines = append(lines, "", description)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -3,24 +3,72 @@ package cache
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	ics "github.com/arran4/golang-ical"
 )
 
+const (
+	version = 1
+	// headerLen is the length of the version, issued at, and expiry times.
+	headerLen = 1 + 8 + 8
+	// maxClockSkew is how far in the future a cache may have been issued,
+	// to allow for the clocks of servers sharing a key to differ.
+	maxClockSkew = time.Minute
+)
+
+var (
+	ErrBadSignature = errors.New("bad cache signature")
+	ErrExpired      = errors.New("cache expired")
+	ErrNotYetIssued = errors.New("cache issued in the future")
+)
+
 type Webcal struct {
 	URL      string
 	Calendar *ics.Calendar
+	// Expires is when the cache expires, if it is zero then Encode sets it.
+	Expires time.Time
 }
 
-func ParseWebcal(c string) (Webcal, error) {
-	rawGzip, err := base64.StdEncoding.DecodeString(c)
+// ParseWebcal decodes a cache made by Encode. It returns an error if the cache
+// was not signed with key, if it has expired at now, if it was issued more than
+// maxAge before now, or if it was issued after now.
+func ParseWebcal(c string, key []byte, now time.Time, maxAge time.Duration) (Webcal, error) {
+	raw, err := base64.StdEncoding.DecodeString(c)
 	if err != nil {
 		return Webcal{}, fmt.Errorf("error decoding cache: %w", err)
 	}
-	r, err := gzip.NewReader(bytes.NewReader(rawGzip))
+	if len(raw) < headerLen+sha256.Size {
+		return Webcal{}, ErrBadSignature
+	}
+	signed, signature := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+	if !hmac.Equal(signature, sign(key, signed)) {
+		return Webcal{}, ErrBadSignature
+	}
+
+	if signed[0] != version {
+		return Webcal{}, fmt.Errorf("unsupported cache version: %d", signed[0])
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(signed[1:9])), 0).UTC()
+	if issued.After(now.Add(maxClockSkew)) {
+		return Webcal{}, fmt.Errorf("%w at %s", ErrNotYetIssued, issued)
+	}
+	if now.Sub(issued) >= maxAge {
+		return Webcal{}, fmt.Errorf("%w, issued at %s", ErrExpired, issued)
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(signed[9:headerLen])), 0).UTC()
+	if !now.Before(expires) {
+		return Webcal{}, fmt.Errorf("%w at %s", ErrExpired, expires)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(signed[headerLen:]))
 	if err != nil {
 		return Webcal{}, fmt.Errorf("error decoding cache headers: %w", err)
 	}
@@ -29,7 +77,8 @@ func ParseWebcal(c string) (Webcal, error) {
 		return Webcal{}, fmt.Errorf("error decoding cache body: %w", err)
 	}
 	cache := Webcal{
-		URL: r.Name,
+		URL:     r.Name,
+		Expires: expires,
 	}
 	if cache.Calendar, err = ics.ParseCalendar(bytes.NewReader(calendarBytes)); err != nil {
 		return Webcal{}, fmt.Errorf("error parsing cached calendar: %w", err)
@@ -37,8 +86,15 @@ func ParseWebcal(c string) (Webcal, error) {
 	return cache, nil
 }
 
-func (c Webcal) Encode() (string, error) {
-	b := bytes.NewBuffer([]byte{})
+// Encode encodes the cache and signs it with key. The cache is issued at now
+// and expires at c.Expires, or after maxAge if c.Expires is zero.
+func (c Webcal) Encode(key []byte, now time.Time, maxAge time.Duration) (string, error) {
+	expires := c.Expires
+	if expires.IsZero() {
+		expires = now.Add(maxAge)
+	}
+
+	b := bytes.NewBuffer(make([]byte, headerLen))
 	w, err := gzip.NewWriterLevel(b, gzip.BestCompression)
 	if err != nil {
 		return "", fmt.Errorf("error creating cache: %w", err)
@@ -50,5 +106,17 @@ func (c Webcal) Encode() (string, error) {
 	if err := w.Close(); err != nil {
 		return "", fmt.Errorf("error finalising cache: %w", err)
 	}
-	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+
+	signed := b.Bytes()
+	signed[0] = version
+	binary.BigEndian.PutUint64(signed[1:9], uint64(now.Unix()))
+	binary.BigEndian.PutUint64(signed[9:headerLen], uint64(expires.Unix()))
+
+	return base64.StdEncoding.EncodeToString(append(signed, sign(key, signed)...)), nil
+}
+
+func sign(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
 }
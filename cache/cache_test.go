@@ -2,7 +2,12 @@ package cache_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"testing"
+	"time"
 
 	ics "github.com/arran4/golang-ical"
 	"github.com/brackendawson/webcal-proxy/cache"
@@ -10,6 +15,11 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+var (
+	testKey = []byte("alpacas")
+	testNow = time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC)
+)
+
 func TestWebcal(t *testing.T) {
 	t.Parallel()
 
@@ -21,37 +31,100 @@ func TestWebcal(t *testing.T) {
 			return c
 		}(),
 	}
-	encoded, err := initial.Encode()
+	encoded, err := initial.Encode(testKey, testNow, time.Hour)
 	require.NoError(t, err)
 
 	t.Log(string(encoded))
 	require.Less(t, len(encoded), len(fixtures.CalExample))
 
-	decoded, err := cache.ParseWebcal(encoded)
+	decoded, err := cache.ParseWebcal(encoded, testKey, testNow.Add(time.Hour-time.Second), time.Hour)
 	require.NoError(t, err)
+	initial.Expires = testNow.Add(time.Hour)
 	require.Equal(t, initial, decoded)
+
+	// re-encoding keeps the original expiry
+	reencoded, err := decoded.Encode(testKey, testNow.Add(time.Minute), time.Hour)
+	require.NoError(t, err)
+	redecoded, err := cache.ParseWebcal(reencoded, testKey, testNow.Add(time.Hour-time.Second), time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, initial, redecoded)
 }
 
 func TestParseWebcalErrors(t *testing.T) {
+	valid, err := cache.Webcal{
+		URL: "webcal://alpaca-racing.com/schedule",
+		Calendar: func() *ics.Calendar {
+			c, err := ics.ParseCalendar(bytes.NewReader(fixtures.CalExample))
+			require.NoError(t, err)
+			return c
+		}(),
+	}.Encode(testKey, testNow, time.Hour)
+	require.NoError(t, err)
+
 	for name, test := range map[string]struct {
 		input        string
+		key          []byte
+		now          time.Time
 		requireError func(require.TestingT, error, ...any)
 	}{
-		"bad_base64":      {"I'm not base64", errorContains("error decoding cache: ")},
-		"bad_gzip_header": {"SSdtIG5vdCBnemlw", errorContains("error decoding cache headers: ")},
-		"bad_gzip_body":   {"H4sIACSSdtIG5vdCBnemlwetyEwu5gIAtDzF3gwAAAA=", errorContains("error decoding cache body: ")},
-		"bad_ics":         {"H4sIACmx5GYAA/NUz1XIyy9RyEwu5gIAtDzF3gwAAAA=", errorContains("error parsing cached calendar: ")},
+		"bad_base64":          {input: "I'm not base64", requireError: errorContains("error decoding cache: ")},
+		"too_short":           {input: "SSdtIG5vdCBnemlw", requireError: errorIs(cache.ErrBadSignature)},
+		"wrong_key":           {input: valid, key: []byte("llamas"), requireError: errorIs(cache.ErrBadSignature)},
+		"tampered":            {input: tamper(t, valid), requireError: errorIs(cache.ErrBadSignature)},
+		"expired":             {input: valid, now: testNow.Add(time.Hour), requireError: errorIs(cache.ErrExpired)},
+		"issued_too_long_ago": {input: signed(1, testNow.Add(24*time.Hour), "I'm not gzip"), now: testNow.Add(2 * time.Hour), requireError: errorIs(cache.ErrExpired)},
+		"issued_in_future":    {input: valid, now: testNow.Add(-2 * time.Minute), requireError: errorIs(cache.ErrNotYetIssued)},
+		"bad_version":         {input: signed(2, testNow.Add(time.Hour), "I'm not gzip"), requireError: errorContains("unsupported cache version: 2")},
+		"bad_gzip_header":     {input: signed(1, testNow.Add(time.Hour), "I'm not gzip"), requireError: errorContains("error decoding cache headers: ")},
+		"bad_gzip_body":       {input: signed(1, testNow.Add(time.Hour), "H4sIACSSdtIG5vdCBnemlwetyEwu5gIAtDzF3gwAAAA="), requireError: errorContains("error decoding cache body: ")},
+		"bad_ics":             {input: signed(1, testNow.Add(time.Hour), "H4sIACmx5GYAA/NUz1XIyy9RyEwu5gIAtDzF3gwAAAA="), requireError: errorContains("error parsing cached calendar: ")},
 	} {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
-			_, err := cache.ParseWebcal(test.input)
+			if test.key == nil {
+				test.key = testKey
+			}
+			if test.now.IsZero() {
+				test.now = testNow
+			}
+			_, err := cache.ParseWebcal(test.input, test.key, test.now, time.Hour)
 			test.requireError(t, err)
 		})
 	}
 }
 
+// signed returns a cache with the given version, expiry, and base64 encoded
+// body, signed with testKey.
+func signed(version byte, expires time.Time, body string) string {
+	rawBody, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		rawBody = []byte(body)
+	}
+	b := []byte{version}
+	b = binary.BigEndian.AppendUint64(b, uint64(testNow.Unix()))
+	b = binary.BigEndian.AppendUint64(b, uint64(expires.Unix()))
+	b = append(b, rawBody...)
+	mac := hmac.New(sha256.New, testKey)
+	mac.Write(b)
+	return base64.StdEncoding.EncodeToString(mac.Sum(b))
+}
+
+// tamper extends the expiry of an encoded cache without re-signing it.
+func tamper(t *testing.T, encoded string) string {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint64(b[9:17], uint64(testNow.Add(24*time.Hour).Unix()))
+	return base64.StdEncoding.EncodeToString(b)
+}
+
 func errorContains(contains string) func(require.TestingT, error, ...any) {
 	return func(t require.TestingT, err error, msgAndArgs ...any) {
 		require.ErrorContains(t, err, contains, msgAndArgs...)
 	}
 }
+
+func errorIs(target error) func(require.TestingT, error, ...any) {
+	return func(t require.TestingT, err error, msgAndArgs ...any) {
+		require.ErrorIs(t, err, target, msgAndArgs...)
+	}
+}
@@ -13,6 +13,8 @@ import (
 type Event struct {
 	StartTime, EndTime             time.Time
 	Summary, Location, Description string
+	// Color is the event's CSS colour name or empty string.
+	Color string
 }
 
 type Day struct {
@@ -81,6 +83,9 @@ func appendDay(ctx context.Context, s []Day, target time.Time, downstream *ics.C
 			if description := event.GetProperty(ics.ComponentPropertyDescription); description != nil {
 				newEvent.Description = description.Value
 			}
+			if color := event.GetProperty(ics.ComponentPropertyColor); color != nil {
+				newEvent.Color = color.Value
+			}
 
 			thisDay.Events = append(thisDay.Events, newEvent)
 		}
@@ -114,10 +119,14 @@ type Month struct {
 	// Days are the days in the Target Month plus the days before and after the
 	// target month to fill incomplete leading and trailing weeks.
 	Days []Day
-	// Cache is always the unfiltered upstream ICS or nil.
-	Cache *cache.Webcal
+	// Caches are the unfiltered upstream calendars for the browser to cache, or
+	// nil if the browser's caches are still current.
+	Caches []*cache.Webcal
 	// URL is the new webcal:// link for the User.
 	URL string
+	// Warnings are problems with some of the upstream calendars to show to
+	// the user.
+	Warnings []string
 	// Error is the error to show to the user or empty string.
 	Error string
 }
@@ -129,22 +138,26 @@ func newMonth(ctx context.Context, view View, target, today time.Time, downstrea
 		Now:    today,
 	}
 
-	float := target.AddDate(0, 0, -target.Day()+1)
-	endOfMonth := float.AddDate(0, 1, 0)
-	float = float.AddDate(0, 0, -mondayIndexWeekday(float.Weekday()))
-
-	for float.Before(endOfMonth) {
-		cal.Days = appendDay(ctx, cal.Days, target, downstream, float)
-		float = float.AddDate(0, 0, 1)
-	}
-	for float.Weekday() != time.Monday {
+	start, end := monthRange(target)
+	for float := start; float.Before(end); float = float.AddDate(0, 0, 1) {
 		cal.Days = appendDay(ctx, cal.Days, target, downstream, float)
-		float = float.AddDate(0, 0, 1)
 	}
 
 	return cal
 }
 
+// monthRange returns the start of the first and the end of the last day shown
+// in the month view of target. The view is whole weeks from Monday to Sunday.
+func monthRange(target time.Time) (start, end time.Time) {
+	start = time.Date(target.Year(), target.Month(), 1, 0, 0, 0, 0, target.Location())
+	end = start.AddDate(0, 1, 0)
+	start = start.AddDate(0, 0, -mondayIndexWeekday(start.Weekday()))
+	for end.Weekday() != time.Monday {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
 func mondayIndexWeekday(d time.Weekday) int {
 	return ((int(d)-1)%7 + 7) % 7
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	server "github.com/brackendawson/webcal-proxy"
+	"github.com/gin-contrib/secure"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of environment variables that set configuration,
+// eg WEBCAL_PROXY_MAX_CONNS sets -max-conns.
+const envPrefix = "WEBCAL_PROXY_"
+
+// errInvalidFlags is returned by loadConfig if the flags could not be parsed,
+// the problem and usage have already been written to stderr.
+var errInvalidFlags = errors.New("invalid flags")
+
+// config is the configuration of webcal-proxy. Each field can be set in the
+// config file by its yaml key, by an environment variable, or by the flag of
+// the same name. Flags take precedence over environment variables, which take
+// precedence over the config file.
+type config struct {
+	Addr     string       `yaml:"addr"`
+	LogFile  string       `yaml:"log-file"`
+	LogLevel logrus.Level `yaml:"log-level"`
+
+	MaxConns             int           `yaml:"max-conns"`
+	UpstreamCacheSize    int           `yaml:"upstream-cache-size"`
+	UpstreamMaxAge       time.Duration `yaml:"upstream-max-age"`
+	StaleWhileRevalidate time.Duration `yaml:"stale-while-revalidate"`
+	MaxStale             time.Duration `yaml:"max-stale"`
+	CacheKey             string        `yaml:"cache-key"`
+	CacheMaxAge          time.Duration `yaml:"cache-max-age"`
+	RecurrencePast       time.Duration `yaml:"recurrence-past"`
+	RecurrenceFuture     time.Duration `yaml:"recurrence-future"`
+	MaxRecurrences       int           `yaml:"max-recurrences"`
+
+	UpstreamAllow             stringList `yaml:"upstream-allow"`
+	UpstreamDeny              stringList `yaml:"upstream-deny"`
+	UpstreamAllowCIDRs        stringList `yaml:"upstream-allow-cidrs"`
+	UpstreamDenyCIDRs         stringList `yaml:"upstream-deny-cidrs"`
+	UpstreamAllowPrivateCIDRs stringList `yaml:"upstream-allow-private-cidrs"`
+
+	MetricsAddr   string        `yaml:"metrics-addr"`
+	MetricsHosts  stringList    `yaml:"metrics-hosts"`
+	DrainDelay    time.Duration `yaml:"drain-delay"`
+	ShutdownGrace time.Duration `yaml:"shutdown-grace"`
+
+	Dev                   bool       `yaml:"dev"`
+	AllowedHosts          stringList `yaml:"allowed-hosts"`
+	SSLRedirect           bool       `yaml:"ssl-redirect"`
+	STSSeconds            int64      `yaml:"sts-seconds"`
+	STSIncludeSubdomains  bool       `yaml:"sts-include-subdomains"`
+	STSPreload            bool       `yaml:"sts-preload"`
+	FrameDeny             bool       `yaml:"frame-deny"`
+	ContentTypeNosniff    bool       `yaml:"content-type-nosniff"`
+	BrowserXSSFilter      bool       `yaml:"browser-xss-filter"`
+	ContentSecurityPolicy string     `yaml:"content-security-policy"`
+	ReferrerPolicy        string     `yaml:"referrer-policy"`
+}
+
+func defaultConfig() config {
+	secureConfig := secure.DefaultConfig()
+	return config{
+		Addr:     ":8080",
+		LogLevel: logrus.InfoLevel,
+
+		MaxConns:             8,
+		UpstreamCacheSize:    64,
+		UpstreamMaxAge:       time.Minute,
+		StaleWhileRevalidate: 5 * time.Minute,
+		MaxStale:             24 * time.Hour,
+		CacheMaxAge:          time.Hour,
+		RecurrencePast:       90 * 24 * time.Hour,
+		RecurrenceFuture:     365 * 24 * time.Hour,
+		MaxRecurrences:       1000,
+
+		DrainDelay:    5 * time.Second,
+		ShutdownGrace: 20 * time.Second,
+
+		SSLRedirect:           false, // TLS should be handled by reverse proxy
+		STSSeconds:            secureConfig.STSSeconds,
+		STSIncludeSubdomains:  secureConfig.STSIncludeSubdomains,
+		STSPreload:            secureConfig.STSPreload,
+		FrameDeny:             secureConfig.FrameDeny,
+		ContentTypeNosniff:    secureConfig.ContentTypeNosniff,
+		BrowserXSSFilter:      secureConfig.BrowserXssFilter,
+		ContentSecurityPolicy: "default-src 'self'; script-src 'self'; img-src 'self' data:;", // Bootstrap uses data: images
+	}
+}
+
+// registerFlags registers a flag for each field of c.
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "File to log to")
+	fs.TextVar(&c.LogLevel, "log-level", c.LogLevel, "log level")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "disables security policies that prevent http://localhost from working")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "local address:port to bind to")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "maximum total upstream connections")
+	fs.IntVar(&c.UpstreamCacheSize, "upstream-cache-size", c.UpstreamCacheSize, "maximum upstream calendars to cache for conditional requests, 0 disables")
+	fs.DurationVar(&c.UpstreamMaxAge, "upstream-max-age", c.UpstreamMaxAge, "how long to use a cached upstream calendar for before revalidating it, unless the upstream sends Cache-Control or Expires")
+	fs.DurationVar(&c.StaleWhileRevalidate, "stale-while-revalidate", c.StaleWhileRevalidate, "how long after a cached upstream calendar needs revalidating to serve it while revalidating it in the background")
+	fs.DurationVar(&c.MaxStale, "max-stale", c.MaxStale, "maximum age of a cached upstream calendar to serve when the upstream fails")
+	fs.StringVar(&c.CacheKey, "cache-key", c.CacheKey, "key to sign calendars cached by browsers, share it between instances (default random)")
+	fs.DurationVar(&c.CacheMaxAge, "cache-max-age", c.CacheMaxAge, "maximum age of calendars cached by browsers")
+	fs.DurationVar(&c.RecurrencePast, "recurrence-past", c.RecurrencePast, "how far before now to expand recurring events in calendar feeds")
+	fs.DurationVar(&c.RecurrenceFuture, "recurrence-future", c.RecurrenceFuture, "how far after now to expand recurring events in calendar feeds")
+	fs.IntVar(&c.MaxRecurrences, "max-recurrences", c.MaxRecurrences, "maximum occurrences to expand each recurring event into, events with more are served as they are")
+	fs.Var(&c.UpstreamAllow, "upstream-allow", "comma separated upstream hosts that calendars may be fetched from, globs like *.example.com or suffixes like .example.com, empty allows any")
+	fs.Var(&c.UpstreamDeny, "upstream-deny", "comma separated upstream hosts that calendars may not be fetched from, as for -upstream-allow")
+	fs.Var(&c.UpstreamAllowCIDRs, "upstream-allow-cidrs", "comma separated CIDRs of the public addresses that calendars may be fetched from, empty allows any")
+	fs.Var(&c.UpstreamDenyCIDRs, "upstream-deny-cidrs", "comma separated CIDRs of addresses that calendars may not be fetched from")
+	fs.Var(&c.UpstreamAllowPrivateCIDRs, "upstream-allow-private-cidrs", "comma separated CIDRs of private or loopback addresses that calendars may be fetched from")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "local address:port to serve Prometheus metrics on, empty doesn't serve them")
+	fs.Var(&c.MetricsHosts, "metrics-hosts", "comma separated upstream hosts to label metrics with, other hosts are labelled other")
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "how long to report not ready for when shutting down, before no longer accepting connections")
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", c.ShutdownGrace, "how long to wait for requests to finish when shutting down, before cancelling them")
+	fs.Var(&c.AllowedHosts, "allowed-hosts", "comma separated host names that the server may be reached by, empty allows any")
+	fs.BoolVar(&c.SSLRedirect, "ssl-redirect", c.SSLRedirect, "redirect http requests to https, TLS is usually handled by a reverse proxy")
+	fs.Int64Var(&c.STSSeconds, "sts-seconds", c.STSSeconds, "max-age of the Strict-Transport-Security header, 0 disables it")
+	fs.BoolVar(&c.STSIncludeSubdomains, "sts-include-subdomains", c.STSIncludeSubdomains, "add includeSubdomains to the Strict-Transport-Security header")
+	fs.BoolVar(&c.STSPreload, "sts-preload", c.STSPreload, "add preload to the Strict-Transport-Security header")
+	fs.BoolVar(&c.FrameDeny, "frame-deny", c.FrameDeny, "send X-Frame-Options: DENY")
+	fs.BoolVar(&c.ContentTypeNosniff, "content-type-nosniff", c.ContentTypeNosniff, "send X-Content-Type-Options: nosniff")
+	fs.BoolVar(&c.BrowserXSSFilter, "browser-xss-filter", c.BrowserXSSFilter, "send X-XSS-Protection: 1; mode=block")
+	fs.StringVar(&c.ContentSecurityPolicy, "content-security-policy", c.ContentSecurityPolicy, "Content-Security-Policy header, empty disables it")
+	fs.StringVar(&c.ReferrerPolicy, "referrer-policy", c.ReferrerPolicy, "Referrer-Policy header, empty disables it")
+}
+
+// loadConfig loads the configuration from the config file given by the
+// -config flag or environment variable, the environment, and args, in
+// increasing order of precedence. If -print-config is given then the
+// configuration is written to stdout.
+func loadConfig(args []string, lookupEnv func(string) (string, bool), stdout io.Writer) (cfg config, printConfig bool, err error) {
+	cfg = defaultConfig()
+	var configFile string
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", "", "YAML file to read configuration from, flags and environment variables take precedence over it")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration as YAML and exit, the cache key is redacted")
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return config{}, false, err
+		}
+		// fs has already explained the problem
+		return config{}, false, errInvalidFlags
+	}
+
+	// the flags have already set cfg, so remember them to set again after
+	// the config file and environment
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	if _, ok := flags["config"]; !ok {
+		configFile, _ = lookupEnv(envName("config"))
+	}
+	if configFile != "" {
+		if err := cfg.readFile(configFile); err != nil {
+			return config{}, false, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		// print-config is only a flag so that an environment left set
+		// doesn't stop the server from starting
+		if _, isFlag := flags[f.Name]; isFlag || !ok || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err))
+		}
+	})
+	for name, value := range flags {
+		if err := fs.Set(name, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return config{}, false, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return config{}, false, err
+	}
+
+	if printConfig {
+		printed := cfg
+		if printed.CacheKey != "" {
+			printed.CacheKey = "REDACTED"
+		}
+		enc := yaml.NewEncoder(stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(printed); err != nil {
+			return config{}, false, err
+		}
+	}
+	return cfg, printConfig, nil
+}
+
+// envName returns the name of the environment variable for the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readFile sets the fields of c that are given in the YAML file name.
+func (c *config) readFile(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", name, err)
+	}
+	return nil
+}
+
+// validate returns an error describing every invalid field of c.
+func (c config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "addr must be an address:port, got %q", c.Addr)
+	if c.MetricsAddr != "" {
+		_, _, err := net.SplitHostPort(c.MetricsAddr)
+		check(err == nil, "metrics-addr must be an address:port, got %q", c.MetricsAddr)
+		check(c.MetricsAddr != c.Addr, "metrics-addr must be different to addr")
+	}
+	check(c.MaxConns > 0, "max-conns must be at least 1, got %d", c.MaxConns)
+	check(c.UpstreamCacheSize >= 0, "upstream-cache-size must not be negative, got %d", c.UpstreamCacheSize)
+	check(c.MaxRecurrences > 0, "max-recurrences must be at least 1, got %d", c.MaxRecurrences)
+	check(c.STSSeconds >= 0, "sts-seconds must not be negative, got %d", c.STSSeconds)
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"upstream-max-age", c.UpstreamMaxAge},
+		{"stale-while-revalidate", c.StaleWhileRevalidate},
+		{"max-stale", c.MaxStale},
+		{"recurrence-past", c.RecurrencePast},
+		{"recurrence-future", c.RecurrenceFuture},
+		{"drain-delay", c.DrainDelay},
+		{"shutdown-grace", c.ShutdownGrace},
+	} {
+		check(d.value >= 0, "%s must not be negative, got %s", d.name, d.value)
+	}
+	check(c.CacheMaxAge > 0, "cache-max-age must be more than 0")
+	if _, err := c.upstreamPolicy(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
+
+// upstreamPolicy returns the policy of which upstream hosts calendars may be
+// fetched from.
+func (c config) upstreamPolicy() (server.HostPolicy, error) {
+	var errs []error
+	parseCIDRs := func(name string, cidrs []string) []netip.Prefix {
+		var prefixes []netip.Prefix
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		return prefixes
+	}
+
+	policy := server.HostPolicy{
+		Allow:             c.UpstreamAllow,
+		Deny:              c.UpstreamDeny,
+		AllowCIDRs:        parseCIDRs("upstream-allow-cidrs", c.UpstreamAllowCIDRs),
+		DenyCIDRs:         parseCIDRs("upstream-deny-cidrs", c.UpstreamDenyCIDRs),
+		AllowPrivateCIDRs: parseCIDRs("upstream-allow-private-cidrs", c.UpstreamAllowPrivateCIDRs),
+	}
+	errs = append(errs, policy.Validate())
+	return policy, errors.Join(errs...)
+}
+
+// secureConfig returns the configuration of the secure middleware.
+func (c config) secureConfig() secure.Config {
+	secureConfig := secure.DefaultConfig()
+	secureConfig.IsDevelopment = c.Dev
+	secureConfig.AllowedHosts = c.AllowedHosts
+	secureConfig.SSLRedirect = c.SSLRedirect
+	secureConfig.STSSeconds = c.STSSeconds
+	secureConfig.STSIncludeSubdomains = c.STSIncludeSubdomains
+	secureConfig.STSPreload = c.STSPreload
+	secureConfig.FrameDeny = c.FrameDeny
+	secureConfig.ContentTypeNosniff = c.ContentTypeNosniff
+	secureConfig.BrowserXssFilter = c.BrowserXSSFilter
+	secureConfig.ContentSecurityPolicy = c.ContentSecurityPolicy
+	secureConfig.ReferrerPolicy = c.ReferrerPolicy
+	return secureConfig
+}
+
+// stringList is a list of strings that is given as a flag or environment
+// variable separated by commas.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for name, test := range map[string]struct {
+		inputFile     string
+		inputEnv      map[string]string
+		inputArgs     []string
+		expectedFunc  func(*config)
+		expectedError string
+	}{
+		"defaults": {
+			expectedFunc: func(*config) {},
+		},
+		"precedence": {
+			inputFile: "max-conns: 2\nmax-stale: 1h\ncache-max-age: 2h\n",
+			inputEnv: map[string]string{
+				"WEBCAL_PROXY_MAX_STALE":     "2h",
+				"WEBCAL_PROXY_CACHE_MAX_AGE": "3h",
+			},
+			inputArgs: []string{"-cache-max-age", "4h"},
+			expectedFunc: func(c *config) {
+				c.MaxConns = 2
+				c.MaxStale = 2 * time.Hour
+				c.CacheMaxAge = 4 * time.Hour
+			},
+		},
+		"secure": {
+			inputFile: "allowed-hosts: [cal.example.com]\ncontent-security-policy: default-src 'none'\n",
+			inputEnv:  map[string]string{"WEBCAL_PROXY_STS_SECONDS": "60"},
+			expectedFunc: func(c *config) {
+				c.AllowedHosts = stringList{"cal.example.com"}
+				c.ContentSecurityPolicy = "default-src 'none'"
+				c.STSSeconds = 60
+			},
+		},
+		"upstream_policy": {
+			inputFile: "upstream-allow: [.example.com]\nupstream-allow-private-cidrs: [10.1.0.0/16]\n",
+			inputArgs: []string{"-upstream-deny", "evil.example.com,*.evil.example.com"},
+			expectedFunc: func(c *config) {
+				c.UpstreamAllow = stringList{".example.com"}
+				c.UpstreamDeny = stringList{"evil.example.com", "*.evil.example.com"}
+				c.UpstreamAllowPrivateCIDRs = stringList{"10.1.0.0/16"}
+			},
+		},
+		"bad_upstream_policy": {
+			inputArgs:     []string{"-upstream-deny-cidrs", "10.0.0.0/33", "-upstream-allow", "cal[.example.com"},
+			expectedError: "invalid configuration: upstream-deny-cidrs: netip.ParsePrefix(\"10.0.0.0/33\"): prefix length out of range\nbad host pattern \"cal[.example.com\": syntax error in pattern",
+		},
+		"unknown_field": {
+			inputFile:     "max-cons: 2\n",
+			expectedError: "failed to parse config file CONFIG: yaml: unmarshal errors:\n  line 1: field max-cons not found in type main.config",
+		},
+		"print_config_not_from_env": {
+			inputEnv:     map[string]string{"WEBCAL_PROXY_PRINT_CONFIG": "true"},
+			expectedFunc: func(*config) {},
+		},
+		"bad_env": {
+			inputEnv:      map[string]string{"WEBCAL_PROXY_MAX_CONNS": "lots"},
+			expectedError: `invalid value "lots" for WEBCAL_PROXY_MAX_CONNS: parse error`,
+		},
+		"invalid": {
+			inputArgs:     []string{"-max-conns", "0", "-metrics-addr", ":8080"},
+			expectedError: "invalid configuration: metrics-addr must be different to addr\nmax-conns must be at least 1, got 0",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := []string{"webcal-proxy"}
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if test.inputFile != "" {
+				require.NoError(t, os.WriteFile(configFile, []byte(test.inputFile), 0o600))
+				args = append(args, "-config", configFile)
+			}
+			args = append(args, test.inputArgs...)
+			lookupEnv := func(key string) (string, bool) {
+				v, ok := test.inputEnv[key]
+				return v, ok
+			}
+
+			actual, printConfig, err := loadConfig(args, lookupEnv, &bytes.Buffer{})
+			if test.expectedError != "" {
+				assert.EqualError(t, err, strings.ReplaceAll(test.expectedError, "CONFIG", configFile))
+				return
+			}
+			require.NoError(t, err)
+			assert.False(t, printConfig)
+
+			expected := defaultConfig()
+			test.expectedFunc(&expected)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var stdout bytes.Buffer
+	cfg, printConfig, err := loadConfig([]string{"webcal-proxy", "-print-config", "-cache-key", "secret"}, func(string) (string, bool) { return "", false }, &stdout)
+	require.NoError(t, err)
+	assert.True(t, printConfig)
+	assert.Equal(t, "secret", cfg.CacheKey)
+	assert.Contains(t, stdout.String(), "cache-key: REDACTED\n")
+	assert.Contains(t, stdout.String(), "max-conns: 8\n")
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	server "github.com/brackendawson/webcal-proxy"
 	"github.com/gin-contrib/secure"
@@ -13,24 +18,25 @@ import (
 )
 
 func main() {
-	var (
-		addr         string
-		logFile      string
-		logLevel     logrus.Level
-		secureConfig secure.Config = secure.DefaultConfig()
-		maxConns     int
-	)
-	flag.StringVar(&logFile, "log-file", "", "File to log to")
-	flag.TextVar(&logLevel, "log-level", logrus.InfoLevel, "log level")
-	flag.BoolVar(&secureConfig.IsDevelopment, "dev", false, "disables security policies that prevent http://localhost from working")
-	flag.StringVar(&addr, "addr", ":8080", "local address:port to bind to")
-	flag.IntVar(&maxConns, "max-conns", 8, "maximum total upstream connections")
-	flag.Parse()
-
-	logrus.SetLevel(logLevel)
-
-	if logFile != "" {
-		logFH, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	cfg, printConfig, err := loadConfig(os.Args, os.LookupEnv, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if errors.Is(err, errInvalidFlags) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		os.Exit(0)
+	}
+
+	logrus.SetLevel(cfg.LogLevel)
+
+	if cfg.LogFile != "" {
+		logFH, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Failed to open log file: ", err)
 			os.Exit(1)
@@ -43,14 +49,69 @@ func main() {
 	r := gin.New()
 	r.RedirectTrailingSlash = false // be permissie, gin is not aware of Proxy Path
 	r.RedirectFixedPath = true
-	secureConfig.SSLRedirect = false                                                                    // TLS should be handled by reverse proxy
-	secureConfig.ContentSecurityPolicy = "default-src 'self'; script-src 'self'; img-src 'self' data:;" // Bootstrap uses data: images
-	r.Use(secure.New(secureConfig))
-	server.New(r, server.MaxConns(maxConns))
+	r.Use(secure.New(cfg.secureConfig()))
+	opts := []server.Opt{
+		server.MaxConns(cfg.MaxConns),
+		server.UpstreamCacheSize(cfg.UpstreamCacheSize),
+		server.UpstreamMaxAge(cfg.UpstreamMaxAge),
+		server.StaleWhileRevalidate(cfg.StaleWhileRevalidate),
+		server.MaxStale(cfg.MaxStale),
+		server.CacheMaxAge(cfg.CacheMaxAge),
+		server.RecurrenceHorizon(cfg.RecurrencePast, cfg.RecurrenceFuture),
+		server.MaxRecurrences(cfg.MaxRecurrences),
+	}
+	// validated by loadConfig
+	policy, _ := cfg.upstreamPolicy()
+	opts = append(opts, server.UpstreamPolicy(policy))
+	if cfg.CacheKey != "" {
+		opts = append(opts, server.CacheKey([]byte(cfg.CacheKey)))
+	} else {
+		logrus.Info("No -cache-key, using a random key. Browser caches will not survive restarts or work across instances.")
+	}
+	if len(cfg.MetricsHosts) > 0 {
+		opts = append(opts, server.MetricsHosts(cfg.MetricsHosts...))
+	}
+	s := server.New(r, opts...)
 
-	if secureConfig.IsDevelopment {
+	if cfg.Dev {
 		logrus.Warn("In development mode, some security policies disabled to allow http://localhost/ to work.")
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{Addr: cfg.Addr, Handler: r}
 	logrus.Info("Begin listener...")
-	logrus.Fatal(http.ListenAndServe(addr, r))
+	go listen(httpServer)
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsServer = &http.Server{Addr: cfg.MetricsAddr, Handler: s.MetricsHandler()}
+		logrus.Infof("Serving metrics on %s", cfg.MetricsAddr)
+		go listen(metricsServer)
+	}
+
+	<-ctx.Done()
+	stop() // a second signal stops immediately
+	logrus.Infof("Shutting down, no longer ready. Waiting %s for load balancers to notice.", cfg.DrainDelay)
+	s.Drain()
+	time.Sleep(cfg.DrainDelay)
+
+	logrus.Infof("Waiting up to %s for requests to finish.", cfg.ShutdownGrace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("Requests did not finish, cancelling them: %s", err)
+	}
+	// cancel any upstream fetches left, including background revalidations
+	s.Close()
+	_ = httpServer.Close()
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	logrus.Info("Shut down.")
+}
+
+func listen(s *http.Server) {
+	if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logrus.Fatal(err)
+	}
 }
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// defaultCSVColumns are the columns of CSV output if none are given.
+var defaultCSVColumns = []csvColumn{
+	{property: ics.ComponentPropertyDtStart},
+	{property: ics.ComponentPropertyDtEnd},
+	{property: ics.ComponentPropertySummary},
+	{property: ics.ComponentPropertyLocation},
+	{property: ics.ComponentPropertyDescription},
+}
+
+// csvColumn is a column of CSV output holding a property, or one of its
+// parameters, of each event.
+type csvColumn struct {
+	property  ics.ComponentProperty
+	parameter string
+}
+
+func (c csvColumn) field() string {
+	return matcher{property: c.property, parameter: c.parameter}.field()
+}
+
+// parseCSVColumns parses a comma separated list of fields in the form
+// PROPERTY[;PARAMETER].
+func parseCSVColumns(cols string) ([]csvColumn, error) {
+	var columns []csvColumn
+	for i, field := range strings.Split(cols, ",") {
+		property, parameter, ok := parseField(strings.TrimSpace(field))
+		if !ok || isTimeProperty(property) {
+			return nil, fmt.Errorf("invalid field %q at index %d, should be <PROPERTY> or <PROPERTY>;<PARAMETER>", field, i)
+		}
+		columns = append(columns, csvColumn{
+			property:  property,
+			parameter: parameter,
+		})
+	}
+	return columns, nil
+}
+
+// csvRow is an event, or the part of an event on one day, in CSV output.
+type csvRow struct {
+	event      *ics.VEvent
+	start, end time.Time
+	// hasTimes is false for events without a start, their DTSTART and DTEND
+	// are rendered like any other property.
+	hasTimes bool
+	allDay   bool
+}
+
+// writeCSV writes a header and a row for each event in calendar. Times are
+// rendered in loc and, if split is true, events are split into a row for each
+// day they are on in loc.
+func writeCSV(w io.Writer, calendar *ics.Calendar, columns []csvColumn, loc *time.Location, split bool) error {
+	if len(columns) == 0 {
+		columns = defaultCSVColumns
+	}
+
+	cw := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.field()
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, event := range calendar.Events() {
+		rows := []csvRow{newCSVRow(event)}
+		if split {
+			rows = rows[0].splitDays(loc)
+		}
+		for _, row := range rows {
+			record := make([]string, len(columns))
+			for i, column := range columns {
+				record[i] = csvEscape(row.value(column, loc))
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func newCSVRow(event *ics.VEvent) csvRow {
+	row := csvRow{event: event}
+	dtStart := event.GetProperty(ics.ComponentPropertyDtStart)
+	if dtStart == nil {
+		return row
+	}
+	row.allDay = isDate(dtStart.BaseProperty)
+
+	var err error
+	if row.allDay {
+		row.start, err = event.GetAllDayStartAt()
+	} else {
+		row.start, err = event.GetStartAt()
+	}
+	if err != nil {
+		return row
+	}
+	row.hasTimes = true
+
+	if row.allDay {
+		row.end, err = event.GetAllDayEndAt()
+	} else {
+		row.end, err = event.GetEndAt()
+	}
+	if err != nil || row.end.Before(row.start) {
+		row.end = row.start
+	}
+	return row
+}
+
+// splitDays splits the row at each midnight in loc. All day events are split
+// into whole days.
+func (r csvRow) splitDays(loc *time.Location) []csvRow {
+	if !r.hasTimes {
+		return []csvRow{r}
+	}
+
+	start := r.start
+	if !r.allDay {
+		start = start.In(loc)
+	}
+	var rows []csvRow
+	for {
+		midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+		if !midnight.Before(r.end) {
+			break
+		}
+		row := r
+		row.start, row.end = start, midnight
+		rows = append(rows, row)
+		start = midnight
+	}
+	row := r
+	row.start = start
+	return append(rows, row)
+}
+
+// value renders the column for the row. If the property appears more than
+// once then every instance is rendered, separated by commas.
+func (r csvRow) value(column csvColumn, loc *time.Location) string {
+	if r.hasTimes && column.parameter == "" {
+		switch column.property {
+		case ics.ComponentPropertyDtStart:
+			return csvTime(r.start, r.allDay, loc)
+		case ics.ComponentPropertyDtEnd:
+			return csvTime(r.end, r.allDay, loc)
+		}
+	}
+
+	var values []string
+	for _, property := range r.event.Properties {
+		if !strings.EqualFold(property.IANAToken, string(column.property)) {
+			continue
+		}
+		if column.parameter != "" {
+			for key, parameterValues := range property.ICalParameters {
+				if strings.EqualFold(key, column.parameter) {
+					values = append(values, parameterValues...)
+				}
+			}
+			continue
+		}
+		switch property.GetValueType() {
+		case ics.ValueDataTypeDate, ics.ValueDataTypeDateTime:
+			times, err := parseTimes(property)
+			if err != nil {
+				values = append(values, property.Value)
+				continue
+			}
+			for _, t := range times {
+				values = append(values, csvTime(t, property.GetValueType() == ics.ValueDataTypeDate, loc))
+			}
+		default:
+			values = append(values, property.Value)
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// csvEscape prefixes value with ' if it starts with a character that makes
+// spreadsheets evaluate it as a formula, so that an event can't run one.
+func csvEscape(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvTime renders t in loc in a form spreadsheets understand, all day times
+// are rendered as dates.
+func csvTime(t time.Time, allDay bool, loc *time.Location) string {
+	if allDay {
+		return t.Format(time.DateOnly)
+	}
+	return t.In(loc).Format(time.DateTime)
+}
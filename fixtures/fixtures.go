@@ -27,10 +27,92 @@ var (
 	CalMerged []byte
 	//go:embed events11Sept2024.ics
 	Events11Sept2024 []byte
+	//go:embed events11Sept2024OnlyPicnic.ics
+	Events11Sept2024OnlyPicnic []byte
+	//go:embed events11Sept2024WithoutBirthday.ics
+	Events11Sept2024WithoutBirthday []byte
 	//go:embed emptyCalendar.ics
 	EmptyCalendar []byte
 	//go:embed allDayEvent.ics
 	AllDayEvent []byte
+	//go:embed allDayEventWithoutValue.ics
+	AllDayEventWithoutValue []byte
+	//go:embed allDayEventEvents.json
+	AllDayEventEvents []byte
+	//go:embed durationEvents.ics
+	DurationEvents []byte
+	//go:embed durationEventsEvents.json
+	DurationEventsEvents []byte
 	//go:embed multiDayEvent.ics
 	MultiDayEvent []byte
+	//go:embed holidays2024.ics
+	Holidays2024 []byte
+	//go:embed eventsAndHolidays2024.ics
+	EventsAndHolidays2024 []byte
+	//go:embed eventsAndLabelledHolidays2024.ics
+	EventsAndLabelledHolidays2024 []byte
+	//go:embed meetings.ics
+	Meetings []byte
+	//go:embed meetingsNotDeclined.ics
+	MeetingsNotDeclined []byte
+	//go:embed meetingsNotDeclinedByMe.ics
+	MeetingsNotDeclinedByMe []byte
+	//go:embed meetingsOnlyRetro.ics
+	MeetingsOnlyRetro []byte
+	//go:embed meetingsPrivate.ics
+	MeetingsPrivate []byte
+	//go:embed outlookMeeting.ics
+	OutlookMeeting []byte
+	//go:embed outlookMeetingPrivate.ics
+	OutlookMeetingPrivate []byte
+	//go:embed rewrite.ics
+	Rewrite []byte
+	//go:embed rewritten.ics
+	Rewritten []byte
+	//go:embed shifts.ics
+	Shifts []byte
+	//go:embed shiftsOutOfHours.ics
+	ShiftsOutOfHours []byte
+	//go:embed shiftsWithoutHandover.ics
+	ShiftsWithoutHandover []byte
+	//go:embed shiftsOvertime.ics
+	ShiftsOvertime []byte
+	//go:embed recurring.ics
+	Recurring []byte
+	//go:embed recurringExpanded.ics
+	RecurringExpanded []byte
+	//go:embed recurringOnlyMoved.ics
+	RecurringOnlyMoved []byte
+	//go:embed recurringStandupNotExpanded.ics
+	RecurringStandupNotExpanded []byte
+	//go:embed recurringHourly.ics
+	RecurringHourly []byte
+	//go:embed recurringHourlyExpanded.ics
+	RecurringHourlyExpanded []byte
+	//go:embed busy.ics
+	Busy []byte
+	//go:embed busyFreeBusy.ics
+	BusyFreeBusy []byte
+	//go:embed alarms.ics
+	Alarms []byte
+	//go:embed alarmsAdded.ics
+	AlarmsAdded []byte
+	//go:embed alarmsReplaced.ics
+	AlarmsReplaced []byte
+	//go:embed events11Sept2024JCal.json
+	Events11Sept2024JCal []byte
+	//go:embed events11Sept2024Events.json
+	Events11Sept2024Events []byte
+	//go:embed events11Sept2024Upcoming.xml
+	Events11Sept2024Upcoming []byte
+	//go:embed events11Sept2024XCal.xml
+	Events11Sept2024XCal []byte
+	//go:embed meetingsXCal.xml
+	MeetingsXCal []byte
+	//go:embed standup.ics
+	Standup []byte
+	//go:embed standupJCal.json
+	StandupJCal []byte
+	//go:embed formulas.ics
+	Formulas []byte
 )
@@ -54,6 +54,11 @@ func daysSeptember2024In(l *time.Location) []server.Day {
 }
 
 var (
+	testCacheKey = []byte("alpacas")
+	// testCacheIssued is when test caches are issued, they are valid for
+	// one hour.
+	testCacheIssued = time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC)
+
 	locSydney  = must(time.LoadLocation("Australia/Sydney"))
 	locNewYork = must(time.LoadLocation("America/New_York"))
 
@@ -127,6 +132,49 @@ var (
 		return c
 	}()
 
+	daysSept2024WithRecurringEvents = func() []server.Day {
+		c := daysSeptember2024In(time.UTC)
+		for i := range c {
+			for _, date := range []time.Time{
+				time.Date(2024, 9, 5, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 9, 19, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 10, 3, 0, 0, 0, 0, time.UTC),
+			} {
+				if c[i].Time.Equal(date) {
+					c[i].Events = append(c[i].Events, server.Event{
+						StartTime: date,
+						EndTime:   date.AddDate(0, 0, 1),
+						Summary:   "Bin day",
+					})
+				}
+			}
+			c[i].Events = append(c[i].Events, server.Event{
+				StartTime: c[i].Time.Add(9 * time.Hour),
+				EndTime:   c[i].Time.Add(10 * time.Hour),
+				Summary:   "Daily",
+			})
+		}
+		c[2+5].Events = append(c[2+5].Events, server.Event{
+			StartTime: time.Date(2024, 9, 2, 9, 0, 0, 0, time.UTC),
+			EndTime:   time.Date(2024, 9, 2, 9, 15, 0, 0, time.UTC),
+			Summary:   "Standup",
+			Location:  "Office",
+		})
+		c[16+5].Events = append(c[16+5].Events, server.Event{
+			StartTime: time.Date(2024, 9, 16, 10, 0, 0, 0, time.UTC),
+			EndTime:   time.Date(2024, 9, 16, 10, 15, 0, 0, time.UTC),
+			Summary:   "Standup (moved)",
+			Location:  "Office",
+		})
+		c[23+5].Events = append(c[23+5].Events, server.Event{
+			StartTime: time.Date(2024, 9, 23, 9, 0, 0, 0, time.UTC),
+			EndTime:   time.Date(2024, 9, 23, 9, 15, 0, 0, time.UTC),
+			Summary:   "Standup",
+			Location:  "Office",
+		})
+		return c
+	}()
+
 	daysSept2024WithEventsSydney = func() []server.Day {
 		c := daysSeptember2024In(locSydney)
 		c[10+5].Events = []server.Event{
@@ -158,6 +206,41 @@ var (
 	}()
 )
 
+// withColor returns a copy of days with every event's colour set to color.
+func withColor(days []server.Day, color string) []server.Day {
+	coloured := make([]server.Day, len(days))
+	for i, day := range days {
+		coloured[i] = day
+		if day.Events == nil {
+			continue
+		}
+		coloured[i].Events = make([]server.Event, len(day.Events))
+		for j, event := range day.Events {
+			event.Color = color
+			coloured[i].Events[j] = event
+		}
+	}
+	return coloured
+}
+
+func withSummary(days []server.Day, old, new string) []server.Day {
+	renamed := make([]server.Day, len(days))
+	for i, day := range days {
+		renamed[i] = day
+		if day.Events == nil {
+			continue
+		}
+		renamed[i].Events = make([]server.Event, len(day.Events))
+		for j, event := range day.Events {
+			if event.Summary == old {
+				event.Summary = new
+			}
+			renamed[i].Events[j] = event
+		}
+	}
+	return renamed
+}
+
 func must[T any](v T, err error) T {
 	if err != nil {
 		panic(err)
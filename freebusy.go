@@ -0,0 +1,59 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// freeBusy returns a calendar with a VFREEBUSY component holding the busy
+// periods of the events in downstream between from and to. Transparent and
+// cancelled events are not busy.
+func freeBusy(downstream *ics.Calendar, sources []source, from, to, now time.Time) *ics.Calendar {
+	var busy []*ics.VEvent
+	for _, event := range downstream.Events() {
+		if transp := event.GetProperty(ics.ComponentPropertyTransp); transp != nil &&
+			strings.EqualFold(transp.Value, string(ics.TransparencyTransparent)) {
+			continue
+		}
+		if status := event.GetProperty(ics.ComponentPropertyStatus); status != nil &&
+			strings.EqualFold(status.Value, string(ics.ObjectStatusCancelled)) {
+			continue
+		}
+		busy = append(busy, event)
+	}
+
+	calendar := &ics.Calendar{
+		CalendarProperties: downstream.CalendarProperties,
+	}
+	freeBusy := calendar.AddBusy(sourcesID(sources) + "@webcal-proxy")
+	freeBusy.SetDtStampTime(now)
+	freeBusy.SetStartAt(from)
+	freeBusy.SetProperty(ics.ComponentPropertyDtEnd, to.UTC().Format(icalDateTimeUTC))
+
+	// mergeEvents needs the events sorted by start time, which downstream
+	// events are.
+	for _, event := range mergeEvents(busy) {
+		start, err := event.GetStartAt()
+		if err != nil {
+			continue
+		}
+		end, err := eventEnd(event)
+		if err != nil {
+			continue
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		freeBusy.AddProperty(ics.ComponentPropertyFreebusy, start.UTC().Format(icalDateTimeUTC)+"/"+end.UTC().Format(icalDateTimeUTC))
+	}
+
+	return calendar
+}
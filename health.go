@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// wedgedAfter is how long every upstream connection can be in use before the
+// server is considered wedged. Fetches are
+// limited by the client's timeout, so this should never happen.
+const wedgedAfter = 2 * requestTimeoutSecs * time.Second
+
+// HandleHealthz reports that the server is alive, it does no work so that it
+// is cheap to call often.
+func (s *Server) HandleHealthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// HandleReadyz reports whether the server can accept work. It isn't ready
+// once it has been drained or if every upstream connection has been in use
+// for too long.
+func (s *Server) HandleReadyz(c *gin.Context) {
+	if s.draining.Load() {
+		c.String(http.StatusServiceUnavailable, "draining")
+		return
+	}
+	if s.wedged() {
+		c.String(http.StatusServiceUnavailable, "upstream connections wedged")
+		return
+	}
+	c.String(http.StatusOK, "ok")
+}
+
+// Drain makes the server report that it isn't ready, so that load balancers
+// stop sending it new requests before it shuts down. Requests are still
+// served.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// wedged returns true if every upstream connection has been in use for
+// wedgedAfter.
+func (s *Server) wedged() bool {
+	if len(s.semaphore) < cap(s.semaphore) {
+		return false
+	}
+	// while every connection is in use the last change was the one that
+	// took the last connection
+	lastChange := time.Unix(0, s.lastConnChange.Load())
+	return s.now().Sub(lastChange) > wedgedAfter
+}
+
+// takeConn takes an upstream connection from the semaphore, waiting until
+// one is free or ctx is done.
+func (s *Server) takeConn(ctx context.Context) error {
+	select {
+	case s.semaphore <- struct{}{}:
+		s.lastConnChange.Store(s.now().UnixNano())
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseConn releases an upstream connection taken by takeConn.
+func (s *Server) releaseConn() {
+	<-s.semaphore
+	s.lastConnChange.Store(s.now().UnixNano())
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"time"
 )
 
@@ -17,11 +18,17 @@ var (
 	resolver = &net.Resolver{}
 )
 
-func publicUnicastOnlyDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+// dialContext dials addr if p allows it, it is checked here as well as when a
+// calendar URL is given because of redirects and so that a host can't be
+// resolved to a forbidden address.
+func (p HostPolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
+	if !p.allowsHost(host) {
+		return nil, fmt.Errorf("forbidden host: %s", host)
+	}
 
 	ip := net.ParseIP(host)
 
@@ -38,9 +45,8 @@ func publicUnicastOnlyDialContext(ctx context.Context, network, addr string) (ne
 	var dialErrs []error
 	connectTimeout := requestTimeoutSecs * time.Second / time.Duration(len(ipAddrs)+1)
 	for _, ipAddr := range ipAddrs {
-		ip = net.ParseIP(ipAddr)
-		switch {
-		case !ip.IsGlobalUnicast() || ip.IsPrivate():
+		ip, err := netip.ParseAddr(ipAddr)
+		if err != nil || !p.allowsAddr(ip) {
 			dialErrs = append(dialErrs, fmt.Errorf("forbidden address: %s", ipAddr))
 			continue
 		}
@@ -1,32 +1,56 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
 )
 
-func getDownstreamCalendar(upstream *ics.Calendar, opts calenderOptions) *ics.Calendar {
+func (s *Server) getDownstreamCalendar(ctx context.Context, upstreams []upstreamCalendar, opts calenderOptions) *ics.Calendar {
+	// The upstream calendars may be shared with the upstream cache, copy
+	// their events once so that they can be modified below.
+	var calendars []*ics.Calendar
+	for _, upstream := range upstreams {
+		if upstream.err == nil {
+			calendar := cloneCalendar(upstream.calendar)
+			upstream.source.labelEvents(calendar)
+			calendars = append(calendars, calendar)
+		}
+	}
+	upstream := combineCalendars(calendars)
+
 	downstream := ics.NewCalendar()
 
 	for _, component := range upstream.Components {
 		if _, ok := component.(*ics.VEvent); ok {
 			continue
 		}
+		if opts.privateSummary != "" && !isPrivateComponent(component) {
+			continue
+		}
 		downstream.Components = append(downstream.Components, component)
 	}
 	downstream.CalendarProperties = upstream.CalendarProperties
 
-	includes := opts.includes
-	if len(opts.includes) == 0 {
-		includes = defaultMatches
-	}
+	filter := opts.filter()
+	log(ctx).Debugf("Using filter: %s", filter)
 
+	upstreamEvents := upstream.Events()
+	if opts.expand {
+		upstreamEvents = expandEvents(ctx, upstreamEvents, opts.from, opts.to, s.maxRecurrences)
+	}
 	var events []*ics.VEvent
-	for _, event := range upstream.Events() {
-
-		if includes.matches(event) && !opts.excludes.matches(event) {
+	for _, event := range upstreamEvents {
+		if opts.window.contains(event) && filter.matches(event) {
+			opts.rewrites.apply(event)
 			events = append(events, event)
 		}
 	}
@@ -41,6 +65,13 @@ func getDownstreamCalendar(upstream *ics.Calendar, opts calenderOptions) *ics.Ca
 	}
 
 	for _, event := range events {
+		// Alarms are matched before the event is redacted, but are described
+		// by the redacted summary.
+		alarms := opts.alarms.matching(event)
+		if opts.privateSummary != "" {
+			redactEvent(event, opts.privateSummary)
+		}
+		addAlarms(event, alarms, opts.stripAlarms)
 		downstream.AddVEvent(event)
 	}
 
@@ -57,7 +88,7 @@ func mergeEvents(events []*ics.VEvent) []*ics.VEvent {
 
 	for _, event := range events {
 		startTime, _ := event.GetStartAt()
-		endTime, _ := event.GetEndAt()
+		endTime, _ := eventEnd(event)
 		if endTime.Before(startTime) {
 			endTime = startTime
 		}
@@ -101,17 +132,109 @@ func mergeEvents(events []*ics.VEvent) []*ics.VEvent {
 		}
 
 		if endTime.After(lastEndTime) {
-			var props []ics.PropertyParameter
-			for k, v := range event.GetProperty(ics.ComponentPropertyDtEnd).ICalParameters {
-				props = append(props, &ics.KeyValues{
-					Key:   k,
-					Value: v,
-				})
-			}
-			lastEvent.SetProperty(ics.ComponentPropertyDtEnd, event.GetProperty(ics.ComponentPropertyDtEnd).Value, props...)
+			setEventEnd(lastEvent, event, endTime)
 			lastEndTime = endTime
 		}
 	}
 
 	return newEvents
 }
+
+// eventEnd returns when event ends. As in RFC 5545 that is its DTEND, or its
+// DTSTART plus its DURATION, or the day after its DTSTART if that is a date.
+// Events with none of these end when they start.
+func eventEnd(event *ics.VEvent) (time.Time, error) {
+	if event.GetProperty(ics.ComponentPropertyDtEnd) != nil {
+		return event.GetEndAt()
+	}
+	start, err := event.GetStartAt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if duration := event.GetProperty(ics.ComponentProperty(ics.PropertyDuration)); duration != nil {
+		days, d, err := parseICalDuration(duration.Value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return start.AddDate(0, 0, days).Add(d), nil
+	}
+	if isDate(event.GetProperty(ics.ComponentPropertyDtStart).BaseProperty) {
+		return start.AddDate(0, 0, 1), nil
+	}
+	return start, nil
+}
+
+// icalDurationPattern matches an iCal duration, eg PT1H30M, P1D, or -P1W.
+var icalDurationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICalDuration parses an iCal duration into its weeks and days, which
+// are calendar days, and the rest, which is exact.
+func parseICalDuration(value string) (days int, d time.Duration, err error) {
+	value = strings.ToUpper(value)
+	parts := icalDurationPattern.FindStringSubmatch(value)
+	if parts == nil || strings.HasSuffix(value, "P") || strings.HasSuffix(value, "T") {
+		return 0, 0, fmt.Errorf("invalid duration %q", value)
+	}
+	n := func(i int) int {
+		n, _ := strconv.Atoi(parts[i])
+		return n
+	}
+	days = n(2)*7 + n(3)
+	d = time.Duration(n(4))*time.Hour + time.Duration(n(5))*time.Minute + time.Duration(n(6))*time.Second
+	if parts[1] == "-" {
+		return -days, -d, nil
+	}
+	return days, d, nil
+}
+
+// setEventEnd makes event end at end, which is when from ends. The DTEND is
+// copied from from, or made like its DTSTART if it has no DTEND, and any
+// DURATION of event is removed.
+func setEventEnd(event, from *ics.VEvent, end time.Time) {
+	like := from.GetProperty(ics.ComponentPropertyDtEnd)
+	if like == nil {
+		like = from.GetProperty(ics.ComponentPropertyDtStart)
+	}
+	dtEnd := timeProperty(*like, end)
+	dtEnd.IANAToken = string(ics.ComponentPropertyDtEnd)
+
+	event.Properties = slices.DeleteFunc(event.Properties, func(property ics.IANAProperty) bool {
+		return strings.EqualFold(property.IANAToken, string(ics.PropertyDuration))
+	})
+	if event.GetProperty(ics.ComponentPropertyDtEnd) == nil {
+		event.Properties = append(event.Properties, dtEnd)
+		return
+	}
+	setTimeProperty(event, dtEnd)
+}
+
+// cloneCalendar returns a copy of calendar whose events can be changed without
+// affecting the original.
+func cloneCalendar(calendar *ics.Calendar) *ics.Calendar {
+	clone := &ics.Calendar{
+		CalendarProperties: calendar.CalendarProperties,
+		Components:         slices.Clone(calendar.Components),
+	}
+	for i, component := range clone.Components {
+		if event, ok := component.(*ics.VEvent); ok {
+			clone.Components[i] = cloneEvent(event)
+		}
+	}
+	return clone
+}
+
+// cloneEvent returns a copy of event whose properties and sub-components can be
+// changed without affecting the original.
+func cloneEvent(event *ics.VEvent) *ics.VEvent {
+	clone := &ics.VEvent{
+		ComponentBase: ics.ComponentBase{
+			Properties: make([]ics.IANAProperty, len(event.Properties)),
+			Components: slices.Clone(event.Components),
+		},
+	}
+	for i, property := range event.Properties {
+		clone.Properties[i] = property
+		clone.Properties[i].ICalParameters = maps.Clone(property.ICalParameters)
+	}
+	return clone
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// inflightFetch is a fetch of an upstream calendar that may be shared by
+// multiple requests.
+type inflightFetch struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	calendar *ics.Calendar
+	err      error
+}
+
+// inflightFetches coalesces concurrent fetches of the same upstream URL so
+// that they share one request to the upstream server.
+type inflightFetches struct {
+	mu      sync.Mutex
+	fetches map[string]*inflightFetch
+}
+
+func newInflightFetches() *inflightFetches {
+	return &inflightFetches{
+		fetches: make(map[string]*inflightFetch),
+	}
+}
+
+// do calls fetch for url unless another call for url is already in flight, in
+// which case it waits for that call's result. If ctx is done before the
+// result is ready then do returns ctx's error, the fetch is cancelled only
+// once every waiting caller has given up.
+func (f *inflightFetches) do(ctx context.Context, url string, fetch func(context.Context) (*ics.Calendar, error)) (*ics.Calendar, error) {
+	f.mu.Lock()
+	call, ok := f.fetches[url]
+	if ok {
+		log(ctx).Debugf("Joining in-flight fetch of %q", url)
+	} else {
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &inflightFetch{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		f.fetches[url] = call
+
+		go func() {
+			defer cancel()
+			call.calendar, call.err = fetch(fetchCtx)
+
+			f.mu.Lock()
+			f.forget(url, call)
+			f.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.calendar, call.err
+	case <-ctx.Done():
+		f.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// later callers must not join a cancelled fetch
+			f.forget(url, call)
+			call.cancel()
+		}
+		f.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes call from the in-flight fetches if it is still there. f.mu
+// must be held.
+func (f *inflightFetches) forget(url string, call *inflightFetch) {
+	if f.fetches[url] == call {
+		delete(f.fetches, url)
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// jCal returns calendar in the jCal format of RFC 7265, ready to be encoded as
+// JSON.
+func jCal(calendar *ics.Calendar) []any {
+	properties := make([]any, 0, len(calendar.CalendarProperties))
+	for _, property := range calendar.CalendarProperties {
+		properties = append(properties, jCalProperty(property.BaseProperty))
+	}
+	return []any{"vcalendar", properties, jCalComponents(calendar.Components)}
+}
+
+func jCalComponents(components []ics.Component) []any {
+	jComponents := make([]any, 0, len(components))
+	for _, component := range components {
+		properties := make([]any, 0, len(component.UnknownPropertiesIANAProperties()))
+		for _, property := range component.UnknownPropertiesIANAProperties() {
+			properties = append(properties, jCalProperty(property.BaseProperty))
+		}
+		jComponents = append(jComponents, []any{
+			strings.ToLower(componentName(component)),
+			properties,
+			jCalComponents(component.SubComponents()),
+		})
+	}
+	return jComponents
+}
+
+func jCalProperty(property ics.BaseProperty) []any {
+	params := map[string]any{}
+	for key, values := range property.ICalParameters {
+		if strings.EqualFold(key, string(ics.ParameterValue)) {
+			continue
+		}
+		if len(values) == 1 {
+			params[strings.ToLower(key)] = values[0]
+			continue
+		}
+		params[strings.ToLower(key)] = values
+	}
+
+	valueType := valueType(property)
+	jProperty := []any{strings.ToLower(property.IANAToken), params, strings.ToLower(string(valueType))}
+
+	if strings.EqualFold(property.IANAToken, string(ics.PropertyGeo)) {
+		var coordinates []any
+		for _, value := range strings.Split(property.Value, ";") {
+			coordinates = append(coordinates, jCalValue(ics.ValueDataTypeFloat, value))
+		}
+		return append(jProperty, coordinates)
+	}
+
+	for _, value := range splitValues(property, valueType) {
+		jProperty = append(jProperty, jCalValue(valueType, value))
+	}
+	return jProperty
+}
+
+// jCalValue converts a single iCal value of a type to its jCal form, values
+// that can't be converted are left as they are.
+func jCalValue(valueType ics.ValueDataType, value string) any {
+	switch valueType {
+	case ics.ValueDataTypePeriod:
+		start, end, isDuration, ok := splitPeriod(value)
+		if !ok {
+			return value
+		}
+		if !isDuration {
+			end = extendedDateTime(end)
+		}
+		return []any{extendedDateTime(start), end}
+	case ics.ValueDataTypeInteger:
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	case ics.ValueDataTypeFloat:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case ics.ValueDataTypeBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case ics.ValueDataTypeRecur:
+		return jCalRecur(value)
+	}
+	return extendedValue(valueType, value)
+}
+
+// jCalRecur converts a recurrence rule like FREQ=WEEKLY;BYDAY=MO,WE to an
+// object like {"freq": "WEEKLY", "byday": ["MO", "WE"]}.
+func jCalRecur(value string) map[string]any {
+	recur := map[string]any{}
+	for _, part := range splitRecur(value) {
+		var values []any
+		for _, v := range part.values {
+			if containsFold(recurIntegerParts, part.name) {
+				values = append(values, jCalValue(ics.ValueDataTypeInteger, v))
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) == 1 {
+			recur[strings.ToLower(part.name)] = values[0]
+			continue
+		}
+		recur[strings.ToLower(part.name)] = values
+	}
+	return recur
+}
+
+// parseJCal parses a calendar in the jCal format of RFC 7265.
+func parseJCal(r io.Reader) (*ics.Calendar, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	name, base, err := parseJCalComponent(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(name, "vcalendar") {
+		return nil, fmt.Errorf("jCal has %s instead of vcalendar", name)
+	}
+
+	calendar := &ics.Calendar{
+		Components: base.Components,
+	}
+	for _, property := range base.Properties {
+		calendar.CalendarProperties = append(calendar.CalendarProperties, ics.CalendarProperty{BaseProperty: property.BaseProperty})
+	}
+	return calendar, nil
+}
+
+// parseJCalComponent parses a component like ["vevent", [properties...],
+// [components...]].
+func parseJCalComponent(raw json.RawMessage) (string, ics.ComponentBase, error) {
+	var (
+		jComponent  []json.RawMessage
+		name        string
+		jProperties []json.RawMessage
+		jComponents []json.RawMessage
+	)
+	if err := json.Unmarshal(raw, &jComponent); err != nil {
+		return "", ics.ComponentBase{}, err
+	}
+	if len(jComponent) != 3 {
+		return "", ics.ComponentBase{}, errors.New("jCal component should have a name, properties, and components")
+	}
+	for i, v := range []any{&name, &jProperties, &jComponents} {
+		if err := json.Unmarshal(jComponent[i], v); err != nil {
+			return "", ics.ComponentBase{}, err
+		}
+	}
+
+	var base ics.ComponentBase
+	for _, jProperty := range jProperties {
+		property, err := parseJCalProperty(jProperty)
+		if err != nil {
+			return "", ics.ComponentBase{}, err
+		}
+		base.Properties = append(base.Properties, ics.IANAProperty{BaseProperty: property})
+	}
+	for _, jSubComponent := range jComponents {
+		subName, subBase, err := parseJCalComponent(jSubComponent)
+		if err != nil {
+			return "", ics.ComponentBase{}, err
+		}
+		base.Components = append(base.Components, newComponent(subName, subBase))
+	}
+	return name, base, nil
+}
+
+// parseJCalProperty parses a property like ["dtstart", {"tzid": "Europe/London"},
+// "date-time", "2024-09-11T10:00:00"].
+func parseJCalProperty(raw json.RawMessage) (ics.BaseProperty, error) {
+	var (
+		jProperty []json.RawMessage
+		name      string
+		jParams   map[string]json.RawMessage
+		jType     string
+	)
+	if err := json.Unmarshal(raw, &jProperty); err != nil {
+		return ics.BaseProperty{}, err
+	}
+	if len(jProperty) < 4 {
+		return ics.BaseProperty{}, errors.New("jCal property should have a name, parameters, a type, and a value")
+	}
+	for i, v := range []any{&name, &jParams, &jType} {
+		if err := json.Unmarshal(jProperty[i], v); err != nil {
+			return ics.BaseProperty{}, err
+		}
+	}
+
+	property := ics.BaseProperty{
+		IANAToken:      strings.ToUpper(name),
+		ICalParameters: map[string][]string{},
+	}
+	for key, jValue := range jParams {
+		var values []string
+		if err := json.Unmarshal(jValue, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(jValue, &value); err != nil {
+				return ics.BaseProperty{}, err
+			}
+			values = []string{value}
+		}
+		property.ICalParameters[strings.ToUpper(key)] = values
+	}
+
+	valueType := ics.ValueDataType(strings.ToUpper(jType))
+	values := make([]string, 0, len(jProperty)-3)
+	for _, jValue := range jProperty[3:] {
+		value, err := parseJCalValue(valueType, jValue)
+		if err != nil {
+			return ics.BaseProperty{}, err
+		}
+		values = append(values, value)
+	}
+	property.Value = strings.Join(values, ",")
+	setValueType(&property, valueType)
+	return property, nil
+}
+
+// parseJCalValue converts a single jCal value of a type to its iCal form, it is
+// the reverse of jCalValue.
+func parseJCalValue(valueType ics.ValueDataType, raw json.RawMessage) (string, error) {
+	var value any
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&value); err != nil {
+		return "", err
+	}
+
+	switch v := value.(type) {
+	case string:
+		return basicValue(valueType, v), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case []any:
+		// a period is [start, end or duration] and a geo is [latitude,
+		// longitude]
+		parts := make([]string, len(v))
+		for i, part := range v {
+			parts[i] = fmt.Sprint(part)
+		}
+		if valueType == ics.ValueDataTypePeriod && len(parts) == 2 {
+			parts[0] = basicValue(ics.ValueDataTypeDateTime, parts[0])
+			if _, _, isDuration, _ := splitPeriod("/" + parts[1]); !isDuration {
+				parts[1] = basicValue(ics.ValueDataTypeDateTime, parts[1])
+			}
+			return parts[0] + "/" + parts[1], nil
+		}
+		return strings.Join(parts, ";"), nil
+	case map[string]any:
+		return parseJCalRecur(raw)
+	}
+	return "", fmt.Errorf("unsupported jCal value: %s", raw)
+}
+
+// parseJCalRecur converts a recurrence rule object like {"freq": "WEEKLY",
+// "byday": ["MO", "WE"]} to FREQ=WEEKLY;BYDAY=MO,WE, keeping the order of its
+// parts.
+func parseJCalRecur(raw json.RawMessage) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if _, err := d.Token(); err != nil {
+		return "", err
+	}
+
+	var parts []recurPart
+	for d.More() {
+		name, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		var value any
+		if err := d.Decode(&value); err != nil {
+			return "", err
+		}
+		part := recurPart{name: strings.ToUpper(fmt.Sprint(name))}
+		if values, ok := value.([]any); ok {
+			for _, v := range values {
+				part.values = append(part.values, fmt.Sprint(v))
+			}
+		} else {
+			part.values = []string{fmt.Sprint(value)}
+		}
+		parts = append(parts, part)
+	}
+	return joinRecur(parts), nil
+}
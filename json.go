@@ -0,0 +1,71 @@
+package server
+
+import (
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// jsonEvent is an event in the simplified JSON format. Times are RFC 3339, or
+// dates like 2024-09-11 for all day events.
+type jsonEvent struct {
+	UID         string `json:"uid"`
+	Summary     string `json:"summary"`
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	Start       string `json:"start"`
+	End         string `json:"end,omitempty"`
+	AllDay      bool   `json:"allDay"`
+}
+
+// jsonEvents returns the events of calendar in the simplified JSON format,
+// events without a start are left out.
+func jsonEvents(calendar *ics.Calendar) []jsonEvent {
+	events := make([]jsonEvent, 0, len(calendar.Events()))
+	for _, event := range calendar.Events() {
+		allDay := false
+		if dtStart := event.GetProperty(ics.ComponentPropertyDtStart); dtStart != nil {
+			allDay = isDate(dtStart.BaseProperty)
+		}
+
+		start, err := event.GetStartAt()
+		if allDay {
+			start, err = event.GetAllDayStartAt()
+		}
+		if err != nil {
+			continue
+		}
+
+		jEvent := jsonEvent{
+			UID:         propertyValue(event, ics.ComponentPropertyUniqueId),
+			Summary:     propertyValue(event, ics.ComponentPropertySummary),
+			Location:    propertyValue(event, ics.ComponentPropertyLocation),
+			Description: propertyValue(event, ics.ComponentPropertyDescription),
+			Start:       jsonTime(start, allDay),
+			AllDay:      allDay,
+		}
+
+		if end, err := eventEnd(event); err == nil {
+			jEvent.End = jsonTime(end, allDay)
+		}
+
+		events = append(events, jEvent)
+	}
+	return events
+}
+
+func jsonTime(t time.Time, allDay bool) string {
+	if allDay {
+		return t.Format(time.DateOnly)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// propertyValue returns the value of the first instance of property in event,
+// or the empty string.
+func propertyValue(event *ics.VEvent, property ics.ComponentProperty) string {
+	if p := event.GetProperty(property); p != nil {
+		return p.Value
+	}
+	return ""
+}
@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	ics "github.com/arran4/golang-ical"
 )
 
 var (
 	defaultMatches = matchGroup{
-		{
+		matcher{
 			property:   ics.ComponentPropertySummary,
 			expression: regexp.MustCompile(".*"),
 		},
@@ -19,50 +20,150 @@ var (
 
 type Matcher struct {
 	Property, Regex string
+	// For is the regexp that the value of a property must match for its
+	// parameter to be matched, if set.
+	For string
+}
+
+// eventMatcher is a single inc or exc argument.
+type eventMatcher interface {
+	query
+	Matcher() Matcher
 }
 
 type matcher struct {
-	property   ics.ComponentProperty
+	property ics.ComponentProperty
+	// parameter is the property parameter to match instead of the
+	// property's value, if set.
+	parameter  string
 	expression *regexp.Regexp
+	// instance limits the parameter to be matched only on instances of the
+	// property whose value matches, eg the ATTENDEE that is you, if set.
+	instance *regexp.Regexp
 }
 
 func (m matcher) Matcher() Matcher {
-	return Matcher{
-		Property: string(m.property),
+	o := Matcher{
+		Property: m.field(),
 		Regex:    m.expression.String(),
 	}
+	if m.instance != nil {
+		o.For = m.instance.String()
+	}
+	return o
+}
+
+// field returns the property and parameter being matched in the form
+// PROPERTY[;PARAMETER].
+func (m matcher) field() string {
+	if m.parameter == "" {
+		return string(m.property)
+	}
+	return string(m.property) + ";" + m.parameter
+}
+
+// parseField parses a field in the form PROPERTY[;PARAMETER].
+func parseField(field string) (ics.ComponentProperty, string, bool) {
+	property, parameter, hasParameter := strings.Cut(field, ";")
+	if property == "" || hasParameter && (parameter == "" || strings.Contains(parameter, ";") || isTimeProperty(ics.ComponentProperty(property))) {
+		return "", "", false
+	}
+	return ics.ComponentProperty(strings.ToUpper(property)), strings.ToUpper(parameter), true
+}
+
+func (m matcher) String() string {
+	s := m.field() + " =~ " + quoteQuery(m.expression.String())
+	if m.instance != nil {
+		s += " FOR " + quoteQuery(m.instance.String())
+	}
+	return s
+}
+
+// matches returns true if any instance of the property in the event matches
+// the expression. If the matcher has a parameter then any value of the
+// parameter in any instance of the property must match, the instance's value
+// must also match the instance expression if there is one.
+func (m matcher) matches(event *ics.VEvent) bool {
+	for _, property := range event.Properties {
+		if !strings.EqualFold(property.IANAToken, string(m.property)) {
+			continue
+		}
+		if m.parameter == "" {
+			if m.expression.MatchString(property.Value) {
+				return true
+			}
+			continue
+		}
+		if m.instance != nil && !m.instance.MatchString(property.Value) {
+			continue
+		}
+		for key, values := range property.ICalParameters {
+			if !strings.EqualFold(key, m.parameter) {
+				continue
+			}
+			for _, value := range values {
+				if m.expression.MatchString(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
-type matchGroup []matcher
+type matchGroup []eventMatcher
 
-func parseMatchers(m []string) (matchGroup, error) {
+// parseMatchers parses inc or exc arguments, time based pseudo-properties are
+// evaluated in loc.
+func parseMatchers(m []string, loc *time.Location) (matchGroup, error) {
 	matches := make(matchGroup, 0, len(m))
 	for i, matchOpt := range m {
-		parts := strings.Split(matchOpt, "=")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid match parameter %q at index %d, should be <FIELD>=<regexp>", matchOpt, i)
-		}
-		expression, err := regexp.Compile(parts[1])
+		match, err := parseMatcher(matchOpt, i, loc)
 		if err != nil {
-			return nil, fmt.Errorf("bad regexp in match parameter %s at index %d: %w", matchOpt, i, err)
+			return nil, err
 		}
-		matches = append(matches, matcher{
-			property:   ics.ComponentProperty(parts[0]),
-			expression: expression,
-		})
+		matches = append(matches, match)
 	}
 	return matches, nil
 }
 
-func (m matchGroup) matches(event *ics.VEvent) bool {
-	for _, matcher := range m {
-		property := event.GetProperty(matcher.property)
-		if property == nil {
-			return false
+// parseMatcher parses a single matcher in the form <FIELD>=<regexp>, or
+// <PROPERTY>;<PARAMETER>=<regexp>=<regexp> to only match the parameter on
+// instances of the property whose value matches the second regexp. i is its
+// index for error messages.
+func parseMatcher(matchOpt string, i int, loc *time.Location) (eventMatcher, error) {
+	parts := strings.Split(matchOpt, "=")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid match parameter %q at index %d, should be <FIELD>=<regexp>", matchOpt, i)
+	}
+	property, parameter, ok := parseField(parts[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid field %q in match parameter at index %d, should be <PROPERTY> or <PROPERTY>;<PARAMETER>", parts[0], i)
+	}
+	if len(parts) == 3 && parameter == "" {
+		return nil, fmt.Errorf("invalid match parameter %q at index %d, only a <PROPERTY>;<PARAMETER> field can be limited to the instances whose value matches a regexp", matchOpt, i)
+	}
+	if isTimeProperty(property) {
+		timeMatcher, err := parseTimeMatcher(property, parts[1], loc)
+		if err != nil {
+			return nil, fmt.Errorf("bad match parameter %s at index %d: %w", matchOpt, i, err)
 		}
-		if matcher.expression.Match([]byte(property.Value)) {
-			return true
+		return timeMatcher, nil
+	}
+	expression, err := regexp.Compile(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad regexp in match parameter %s at index %d: %w", matchOpt, i, err)
+	}
+	m := matcher{
+		property:   property,
+		parameter:  parameter,
+		expression: expression,
+	}
+	if len(parts) == 3 {
+		m.instance, err = regexp.Compile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp in match parameter %s at index %d: %w", matchOpt, i, err)
 		}
 	}
-	return false
+	return m, nil
 }
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "webcal_proxy"
+	// otherHost is the host label of upstream hosts not given to
+	// MetricsHosts.
+	otherHost = "other"
+)
+
+// Results of looking up a calendar in a cache.
+const (
+	// cacheHit is a calendar used from the cache without asking upstream.
+	cacheHit = "hit"
+	// cacheRevalidated is a cached calendar that upstream said was not
+	// modified.
+	cacheRevalidated = "revalidated"
+	// cacheMiss is a calendar that had to be fetched.
+	cacheMiss = "miss"
+	// cacheStale is a cached calendar used because upstream failed.
+	cacheStale = "stale"
+)
+
+// metrics are the Prometheus metrics of a Server. Each Server has its own
+// registry so that more than one can exist in a process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	requestBytes    *prometheus.CounterVec
+	responseBytes   *prometheus.CounterVec
+
+	fetchDuration *prometheus.HistogramVec
+	fetchErrors   *prometheus.CounterVec
+	upstreamBytes *prometheus.CounterVec
+
+	upstreamCache *prometheus.CounterVec
+	browserCache  *prometheus.CounterVec
+
+	// hosts are the upstream hosts that are labelled by name, set by
+	// MetricsHosts.
+	hosts []string
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests handled, by route, method, and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle requests, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_bytes_total",
+			Help:      "Bytes read from request bodies, by route.",
+		}, []string{"route"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_bytes_total",
+			Help:      "Bytes written to response bodies, by route.",
+		}, []string{"route"}),
+
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_fetch_duration_seconds",
+			Help:      "Time taken to fetch and parse upstream calendars, by host, or other.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"host"}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_fetch_errors_total",
+			Help:      "Upstream calendars that could not be fetched or parsed, by host, or other.",
+		}, []string{"host"}),
+		upstreamBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_response_bytes_total",
+			Help:      "Bytes read from upstream response bodies, by host, or other.",
+		}, []string{"host"}),
+
+		upstreamCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_cache_lookups_total",
+			Help:      "Lookups of upstream calendars in the server's cache, by result: hit, revalidated, miss, or stale.",
+		}, []string{"result"}),
+		browserCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "browser_cache_lookups_total",
+			Help:      "Lookups of upstream calendars in the caches sent by browsers, by result: hit or miss.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.requestBytes,
+		m.responseBytes,
+		m.fetchDuration,
+		m.fetchErrors,
+		m.upstreamBytes,
+		m.upstreamCache,
+		m.browserCache,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_connections_in_use",
+			Help:      "Upstream connections in use.",
+		}, func() float64 { return float64(len(s.semaphore)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_connections_max",
+			Help:      "Maximum upstream connections, set by MaxConns.",
+		}, func() float64 { return float64(cap(s.semaphore)) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// middleware counts requests, how long they took, and the bytes read and
+// written.
+func (m *metrics) middleware(c *gin.Context) {
+	start := time.Now()
+
+	requestRead := oddometer{c.Request.Body, 0}
+	c.Request.Body = &requestRead
+
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	m.requestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+	m.requestBytes.WithLabelValues(route).Add(float64(requestRead.bytes))
+	m.responseBytes.WithLabelValues(route).Add(float64(max(c.Writer.Size(), 0)))
+}
+
+// observeFetch records a fetch of an upstream calendar from rawURL.
+func (m *metrics) observeFetch(rawURL string, duration time.Duration, bytes int, err error) {
+	host := m.hostLabel(rawURL)
+	m.fetchDuration.WithLabelValues(host).Observe(duration.Seconds())
+	m.upstreamBytes.WithLabelValues(host).Add(float64(bytes))
+	if err != nil {
+		m.fetchErrors.WithLabelValues(host).Inc()
+	}
+}
+
+// hostLabel returns the host of rawURL if it is one of the hosts given to
+// MetricsHosts, or other. The URLs come from clients, so labelling every host
+// would let them create any number of series.
+func (m *metrics) hostLabel(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return otherHost
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if !slices.Contains(m.hosts, host) {
+		return otherHost
+	}
+	return host
+}
+
+// MetricsHandler returns a handler that serves the server's metrics to
+// Prometheus. It is not served on the server's router unless MetricsPath is
+// set, so that metrics aren't public.
+func (s *Server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Media types that HandleWebcal can respond with, in order of preference when
+// the client accepts more than one equally.
+const (
+	mediaTypeICal = "text/calendar"
+	mediaTypeHTML = "text/html"
+	mediaTypeJCal = "application/calendar+json"
+	mediaTypeJSON = "application/json"
+	mediaTypeCSV  = "text/csv"
+	mediaTypeAtom = "application/atom+xml"
+	mediaTypeXCal = "application/calendar+xml"
+)
+
+var webcalMediaTypes = []string{mediaTypeICal, mediaTypeHTML, mediaTypeJCal, mediaTypeJSON, mediaTypeCSV, mediaTypeAtom, mediaTypeXCal}
+
+// mediaTypeFormats are the formats served for each media type other than
+// HTML.
+var mediaTypeFormats = map[string]string{
+	mediaTypeICal: "ical",
+	mediaTypeJCal: "jcal",
+	mediaTypeJSON: "json",
+	mediaTypeCSV:  "csv",
+	mediaTypeAtom: "atom",
+	mediaTypeXCal: "xcal",
+}
+
+// negotiate returns the offer most preferred by an Accept header, or the first
+// offer if the header is empty. Ties are broken by the order of offers. If
+// none of offers are acceptable then the empty string is returned.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	var ranges []mediaRange
+	for _, r := range strings.Split(accept, ",") {
+		if mr, ok := parseMediaRange(r); ok {
+			ranges = append(ranges, mr)
+		}
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// mediaRange is one media range from an Accept header, eg text/*;q=0.8.
+type mediaRange struct {
+	mediaType, subType string
+	q                  float64
+}
+
+func parseMediaRange(s string) (mediaRange, bool) {
+	params := strings.Split(s, ";")
+	mediaType, subType, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+	if !ok || mediaType == "" || subType == "" {
+		return mediaRange{}, false
+	}
+
+	mr := mediaRange{
+		mediaType: mediaType,
+		subType:   subType,
+		q:         1,
+	}
+	for _, param := range params[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(key, "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return mediaRange{}, false
+		}
+		mr.q = q
+	}
+	return mr, true
+}
+
+// specificity is higher for media ranges that name a media type more
+// exactly.
+func (m mediaRange) specificity() int {
+	switch {
+	case m.mediaType == "*":
+		return 0
+	case m.subType == "*":
+		return 1
+	}
+	return 2
+}
+
+func (m mediaRange) contains(mediaType, subType string) bool {
+	return (m.mediaType == "*" || m.mediaType == mediaType) &&
+		(m.subType == "*" || m.subType == subType)
+}
+
+// acceptQuality returns the quality of offer given by the most specific media
+// range that contains it, or 0 if none do.
+func acceptQuality(ranges []mediaRange, offer string) float64 {
+	mediaType, subType, _ := strings.Cut(offer, "/")
+	var (
+		q           float64
+		specificity = -1
+	)
+	for _, r := range ranges {
+		if r.contains(mediaType, subType) && r.specificity() > specificity {
+			q, specificity = r.q, r.specificity()
+		}
+	}
+	return q
+}
@@ -4,26 +4,72 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Options struct {
-	URL      string
-	Includes []Matcher
-	Excludes []Matcher
-	Merge    bool
-	Error    string
+	Sources     []Source
+	Includes    []Matcher
+	Excludes    []Matcher
+	Rewrites    []Rewrite
+	Alarms      []Alarm
+	Query       string
+	Timezone    string
+	Merge       bool
+	Private     string
+	StripAlarms bool
+	Format      string
+	Columns     string
+	Split       bool
+	Limit       int
+	From        string
+	To          string
+	Error       string
 }
 
 type calenderOptions struct {
-	url                string
+	sources            []source
 	includes, excludes matchGroup
-	merge              bool
+	rewrites           rewrites
+	alarms             alarms
+	// stripAlarms removes upstream alarms from events.
+	stripAlarms bool
+	// query is the q argument, rawQuery is how it was given.
+	query    query
+	rawQuery string
+	merge    bool
+	// privateSummary replaces the summary of every event and enables privacy
+	// mode if it is set.
+	privateSummary string
+	// format is the format calendar feeds are served in, empty string is
+	// ical.
+	format string
+	// csvColumns are the columns of CSV output, rawColumns is how they were
+	// given.
+	csvColumns []csvColumn
+	rawColumns string
+	// split splits events in CSV output into a row for each day.
+	split bool
+	// limit is the number of upcoming events in feeds, zero is the
+	// default.
+	limit  int
+	window window
+	// location is the time zone that time based pseudo-properties are
+	// evaluated in.
+	location *time.Location
+	// expand is true if recurring events are expanded into their
+	// occurrences, from and to are the horizon within which they are
+	// expanded.
+	expand   bool
+	from, to time.Time
 }
 
-func getCalendarOptions(ctx context.Context, getArray func(string) []string) (calenderOptions, error) {
+func getCalendarOptions(ctx context.Context, getArray func(string) []string, now time.Time) (calenderOptions, error) {
 	var (
 		opts calenderOptions
 		err  error
@@ -34,7 +80,47 @@ func getCalendarOptions(ctx context.Context, getArray func(string) []string) (ca
 		return calenderOptions{}, err
 	}
 
-	opts.includes, err = parseMatchers(getArray("inc"))
+	opts.stripAlarms, err = getBool(ctx, getArray, "stripalarms")
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	opts.format, err = getFormat(ctx, getArray, "fmt")
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	opts.split, err = getBool(ctx, getArray, "split")
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	opts.limit, err = getPositiveInt(ctx, getArray, "limit")
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	if cols := getArray("cols"); len(cols) > 0 && cols[0] != "" {
+		opts.rawColumns = cols[0]
+		opts.csvColumns, err = parseCSVColumns(opts.rawColumns)
+		if err != nil {
+			return calenderOptions{}, newErrorWithMessage(
+				http.StatusBadRequest,
+				"Bad cols argument: %s", err.Error(),
+			)
+		}
+	}
+
+	if prvs := getArray("prv"); len(prvs) > 0 {
+		opts.privateSummary = prvs[0]
+	}
+
+	opts.location, err = getLocation(ctx, getArray, "tz")
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	opts.includes, err = parseMatchers(getArray("inc"), opts.location)
 	if err != nil {
 		return calenderOptions{}, newErrorWithMessage(
 			http.StatusBadRequest,
@@ -42,7 +128,7 @@ func getCalendarOptions(ctx context.Context, getArray func(string) []string) (ca
 		)
 	}
 
-	opts.excludes, err = parseMatchers(getArray("exc"))
+	opts.excludes, err = parseMatchers(getArray("exc"), opts.location)
 	if err != nil {
 		return calenderOptions{}, newErrorWithMessage(
 			http.StatusBadRequest,
@@ -50,7 +136,42 @@ func getCalendarOptions(ctx context.Context, getArray func(string) []string) (ca
 		)
 	}
 
-	opts.url = getString(getArray, "cal")
+	opts.rewrites, err = parseRewrites(getArray("rw"))
+	if err != nil {
+		return calenderOptions{}, newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad rw argument: %s", err.Error(),
+		)
+	}
+
+	opts.alarms, err = parseAlarms(getArray("alarm"), opts.location)
+	if err != nil {
+		return calenderOptions{}, newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad alarm argument: %s", err.Error(),
+		)
+	}
+
+	if qs := getArray("q"); len(qs) > 0 && qs[0] != "" {
+		opts.rawQuery = qs[0]
+		opts.query, err = parseQuery(opts.rawQuery, opts.location)
+		if err != nil {
+			return calenderOptions{}, newErrorWithMessage(
+				http.StatusBadRequest,
+				"Bad q argument: %s", err.Error(),
+			)
+		}
+	}
+
+	opts.sources, err = getSources(ctx, getArray)
+	if err != nil {
+		return calenderOptions{}, err
+	}
+
+	opts.window, err = getWindow(ctx, getArray, now)
+	if err != nil {
+		return calenderOptions{}, err
+	}
 
 	return opts, nil
 }
@@ -73,41 +194,155 @@ func getBool(ctx context.Context, getArray func(string) []string, key string) (b
 	return b, nil
 }
 
-func getString(getArray func(string) []string, key string) string {
-	ss := getArray(key)
-	if len(ss) < 1 {
-		return ""
+// getPositiveInt returns the positive integer given by key, or zero if there
+// isn't one.
+func getPositiveInt(ctx context.Context, getArray func(string) []string, key string) (int, error) {
+	is := getArray(key)
+	if len(is) < 1 || is[0] == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(is[0])
+	if err != nil || i < 1 {
+		log(ctx).Warnf("invalid %q parameter %q", key, is[0])
+		return 0, newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad argument %q for %q, should be a positive number.", is[0], key,
+		)
+	}
+
+	return i, nil
+}
+
+// filter returns the query that events must match to be included, it is the q
+// argument and the translation of the inc and exc arguments. If neither q nor
+// inc are given then events must have a summary.
+func (c calenderOptions) filter() query {
+	includes := c.includes
+	if c.query == nil && len(includes) == 0 {
+		includes = defaultMatches
+	}
+	q := matchersQuery(includes, c.excludes)
+	if c.query == nil {
+		return q
+	}
+	if q == nil {
+		return c.query
+	}
+	return queryAnd{c.query, q}
+}
+
+// needsOccurrences returns true if recurring events must be expanded into
+// their occurrences to serve the calendar in format, because they are filtered,
+// merged, limited, or listed individually. Otherwise recurring events are
+// served as they are.
+func (c calenderOptions) needsOccurrences(format string) bool {
+	return c.query != nil || len(c.includes) > 0 || len(c.excludes) > 0 ||
+		c.merge || c.limit > 0 || !c.window.start.IsZero() || !c.window.end.IsZero() ||
+		slices.Contains(occurrenceFormats, format)
+}
+
+// occurrenceFormats are the formats that list each occurrence of an event.
+var occurrenceFormats = []string{"freebusy", "json", "csv", "atom"}
+
+// formats are the formats calendar feeds can be served in, the default is
+// ical.
+var formats = []string{"ical", "freebusy", "jcal", "json", "csv", "atom", "xcal"}
+
+func getFormat(ctx context.Context, getArray func(string) []string, key string) (string, error) {
+	fs := getArray(key)
+	if len(fs) < 1 || fs[0] == "" {
+		return "", nil
+	}
+
+	format := strings.ToLower(fs[0])
+	if !slices.Contains(formats, format) {
+		log(ctx).Warnf("invalid %q parameter %q", key, fs[0])
+		return "", newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad argument %q for %q, should be one of %s.", fs[0], key, strings.Join(formats, ", "),
+		)
+	}
+
+	return format, nil
+}
+
+// getLocation returns the time zone named by key, or UTC if there isn't one.
+func getLocation(ctx context.Context, getArray func(string) []string, key string) (*time.Location, error) {
+	tzs := getArray(key)
+	if len(tzs) < 1 || tzs[0] == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(tzs[0])
+	if err != nil {
+		log(ctx).Warnf("error getting %q parameter: %s", key, err)
+		return nil, newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad argument %q for %q, should be a time zone like Europe/London.", tzs[0], key,
+		)
 	}
-	return ss[0]
+
+	return loc, nil
 }
 
 func (c calenderOptions) Options() Options {
 	o := Options{
-		URL:   c.url,
-		Merge: c.merge,
+		Query:       c.rawQuery,
+		Merge:       c.merge,
+		Private:     c.privateSummary,
+		StripAlarms: c.stripAlarms,
+		Format:      c.format,
+		Columns:     c.rawColumns,
+		Split:       c.split,
+		Limit:       c.limit,
+		From:        c.window.from,
+		To:          c.window.to,
+	}
+	if c.location != time.UTC {
+		o.Timezone = c.location.String()
 	}
 
+	for _, s := range c.sources {
+		o.Sources = append(o.Sources, s.Source())
+	}
 	for _, i := range c.includes {
 		o.Includes = append(o.Includes, i.Matcher())
 	}
 	for _, e := range c.excludes {
 		o.Excludes = append(o.Excludes, e.Matcher())
 	}
+	for _, r := range c.rewrites {
+		o.Rewrites = append(o.Rewrites, r.Rewrite())
+	}
+	for _, a := range c.alarms {
+		o.Alarms = append(o.Alarms, a.Alarm())
+	}
 
 	return o
 }
 
-func clientURL(c *gin.Context) *url.URL {
+func clientURL(c *gin.Context, sources []source) *url.URL {
 	u := c.Request.URL
 	u.Scheme = "webcal"
 	u.Host = c.GetHeader("X-HX-Host") // Host header is banned in XHR
 	u.Path = c.GetHeader("X-Forwarded-URI") + "/"
 
-	q := url.Values{
-		"cal": c.PostFormArray("cal"),
-		"inc": c.PostFormArray("inc"),
-		"exc": c.PostFormArray("exc"),
-		"mrg": c.PostFormArray("mrg"),
+	q := sourceValues(sources)
+	q["inc"] = c.PostFormArray("inc")
+	q["exc"] = c.PostFormArray("exc")
+	q["rw"] = c.PostFormArray("rw")
+	q["mrg"] = c.PostFormArray("mrg")
+	q["stripalarms"] = c.PostFormArray("stripalarms")
+	for _, alarm := range c.PostFormArray("alarm") {
+		if alarm != "" {
+			q.Add("alarm", alarm)
+		}
+	}
+	for _, key := range []string{"q", "tz", "prv", "from", "to", "fmt", "cols", "split", "limit"} {
+		if value := c.PostForm(key); value != "" {
+			q.Set(key, value)
+		}
 	}
 	u.RawQuery = q.Encode()
 
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// upstreamAccept is the Accept header sent upstream, listing the formats that
+// parseCalendar can read.
+const upstreamAccept = mediaTypeICal + ", " + mediaTypeJCal + ", " + mediaTypeXCal + ", */*;q=0.1"
+
+// parseCalendar parses an upstream calendar in iCal, jCal, or xCal. The format
+// is chosen by the media type of contentType, or by the content of body if
+// the media type doesn't say. Bodies without a media type are parsed as iCal
+// if they don't look like jCal or xCal.
+func parseCalendar(contentType string, body io.Reader) (*ics.Calendar, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	r := bufio.NewReader(body)
+	switch {
+	case isJSONMediaType(mediaType):
+		return parseJCal(r)
+	case isXMLMediaType(mediaType):
+		return parseXCal(r)
+	}
+
+	calendar, err := sniffCalendar(mediaType, r)
+	if err != nil && mediaType == mediaTypeHTML {
+		// Some servers label calendars as HTML, but an HTML body is more
+		// likely a login page than a broken calendar.
+		return nil, unsupportedFormatError(mediaType)
+	}
+	return calendar, err
+}
+
+// sniffCalendar parses r as xCal or jCal if its content looks like them, or as
+// iCal if it looks like iCal or mediaType is iCal or empty.
+func sniffCalendar(mediaType string, r *bufio.Reader) (*ics.Calendar, error) {
+	switch start := peekStart(r); {
+	case bytes.HasPrefix(start, []byte("<")):
+		return parseXCal(r)
+	case bytes.HasPrefix(start, []byte("[")):
+		return parseJCal(r)
+	case mediaType == mediaTypeICal, mediaType == "",
+		len(start) >= 6 && strings.EqualFold(string(start[:6]), "BEGIN:"):
+		return ics.ParseCalendar(r)
+	}
+	return nil, unsupportedFormatError(mediaType)
+}
+
+func unsupportedFormatError(mediaType string) error {
+	return newErrorWithMessage(
+		http.StatusBadGateway,
+		"Unsupported calendar format %q, should be iCal, jCal, or xCal",
+		mediaType,
+	)
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == mediaTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// peekStart returns the start of r without any byte order mark or leading
+// white space, without consuming it.
+func peekStart(r *bufio.Reader) []byte {
+	// Peek returns what it can if r is shorter.
+	start, _ := r.Peek(512)
+	start = bytes.TrimPrefix(start, []byte("\xef\xbb\xbf"))
+	return bytes.TrimSpace(start)
+}
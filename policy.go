@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+)
+
+// HostPolicy decides which upstream hosts calendars may be fetched from. The
+// zero HostPolicy allows any host with a public unicast address.
+//
+// Host patterns are either globs like *.example.com, where * matches any part
+// of a host name, or suffixes like .example.com, which match example.com and
+// all of its subdomains. Host names are compared case-insensitively.
+type HostPolicy struct {
+	// Allow are the host patterns that may be fetched from, if there are
+	// any then no other hosts may be.
+	Allow []string
+	// Deny are the host patterns that may not be fetched from, they take
+	// precedence over Allow.
+	Deny []string
+	// AllowCIDRs are the public addresses that may be connected to, if there
+	// are any then no other public addresses may be.
+	AllowCIDRs []netip.Prefix
+	// DenyCIDRs are the addresses that may not be connected to, they take
+	// precedence over the other CIDRs.
+	DenyCIDRs []netip.Prefix
+	// AllowPrivateCIDRs are private, loopback, or other non-public addresses
+	// that may be connected to, which are forbidden otherwise.
+	AllowPrivateCIDRs []netip.Prefix
+}
+
+// UpstreamPolicy sets which upstream hosts calendars may be fetched from. Host
+// names are checked when a calendar URL is given and again when connecting,
+// addresses are checked when connecting so that a host name can't be
+// resolved to a forbidden address.
+func UpstreamPolicy(p HostPolicy) Opt {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// Validate returns an error if any of the host patterns are malformed.
+func (p HostPolicy) Validate() error {
+	var errs []error
+	for _, pattern := range slices.Concat(p.Allow, p.Deny) {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			errs = append(errs, fmt.Errorf("bad host pattern %q: %w", pattern, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// allowsURLHost returns true if a calendar URL with host, without a port, may
+// be fetched. If host is an address then it must be allowed by the CIDRs,
+// except that non-public addresses are left for the dialer to refuse.
+func (p HostPolicy) allowsURLHost(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			return !containsAddr(p.DenyCIDRs, addr) && p.allowsHost(host)
+		}
+		return p.allowsAddr(addr) && p.allowsHost(host)
+	}
+	return p.allowsHost(host)
+}
+
+// allowsHost returns true if host, without a port, matches the host
+// patterns.
+func (p HostPolicy) allowsHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesHost(p.Deny, host) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchesHost(p.Allow, host)
+}
+
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddr returns true if addr may be connected to.
+func (p HostPolicy) allowsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(p.DenyCIDRs, addr) {
+		return false
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return containsAddr(p.AllowPrivateCIDRs, addr)
+	}
+	return len(p.AllowCIDRs) == 0 || containsAddr(p.AllowCIDRs, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
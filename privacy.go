@@ -0,0 +1,47 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// keptProperties are the properties that only give an event's times and
+// identity, every other property is removed from events in privacy mode.
+var keptProperties = []ics.ComponentProperty{
+	ics.ComponentPropertyUniqueId,
+	ics.ComponentPropertyDtstamp,
+	ics.ComponentPropertyDtStart,
+	ics.ComponentPropertyDtEnd,
+	ics.ComponentProperty(ics.PropertyDuration),
+	ics.ComponentPropertyRrule,
+	ics.ComponentPropertyRdate,
+	ics.ComponentPropertyExdate,
+	ics.ComponentProperty(ics.PropertyRecurrenceId),
+	ics.ComponentPropertyTransp,
+	ics.ComponentPropertyStatus,
+	ics.ComponentPropertySequence,
+}
+
+// isPrivateComponent returns true if component, other than an event, can be
+// served in privacy mode. Only time zones can, other components such as to-dos
+// and journal entries have details that would be leaked.
+func isPrivateComponent(component ics.Component) bool {
+	_, ok := component.(*ics.VTimezone)
+	return ok
+}
+
+// redactEvent removes everything but the times and identity of event, sets its
+// summary to summary, and marks it private. Alarms are removed as they may
+// describe the event.
+func redactEvent(event *ics.VEvent, summary string) {
+	event.Components = nil
+	event.Properties = slices.DeleteFunc(event.Properties, func(property ics.IANAProperty) bool {
+		return !slices.ContainsFunc(keptProperties, func(kept ics.ComponentProperty) bool {
+			return strings.EqualFold(property.IANAToken, string(kept))
+		})
+	})
+	event.SetSummary(summary)
+	event.SetClass(ics.ClassificationPrivate)
+}
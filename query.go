@@ -0,0 +1,388 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// query is a filter expression that events are included by. The grammar is:
+//
+//	expr    = and { "OR" and }
+//	and     = not { "AND" not }
+//	not     = "NOT" not | primary
+//	primary = "(" expr ")" | FIELD ( "=~" | "!~" ) STRING [ "FOR" STRING ]
+//
+// Where FIELD is an iCal event property, a property and one of its parameters
+// separated by a semicolon (eg ATTENDEE;PARTSTAT), or a time based
+// pseudo-property (eg @START). FOR limits a parameter to be matched only on
+// the instances of the property whose value matches its STRING. STRING is
+// double quoted, \" is a quote and \\ is a backslash, other backslashes are
+// kept as they are. It is a regular expression, or a range for time based
+// pseudo-properties. Keywords are case insensitive.
+type query interface {
+	matches(event *ics.VEvent) bool
+	String() string
+}
+
+type queryOr []query
+
+func (q queryOr) matches(event *ics.VEvent) bool {
+	for _, operand := range q {
+		if operand.matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q queryOr) String() string {
+	return joinQueries(q, " OR ")
+}
+
+type queryAnd []query
+
+func (q queryAnd) matches(event *ics.VEvent) bool {
+	for _, operand := range q {
+		if !operand.matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q queryAnd) String() string {
+	return joinQueries(q, " AND ")
+}
+
+type queryNot struct {
+	query
+}
+
+func (q queryNot) matches(event *ics.VEvent) bool {
+	return !q.query.matches(event)
+}
+
+func (q queryNot) String() string {
+	return "NOT " + joinQueries([]query{q.query}, "")
+}
+
+// joinQueries joins the operands with sep, operands of a different operator are
+// put in parentheses.
+func joinQueries[T ~[]query](operands T, sep string) string {
+	s := make([]string, len(operands))
+	for i, operand := range operands {
+		switch operand.(type) {
+		case queryOr, queryAnd:
+			s[i] = "(" + operand.String() + ")"
+		default:
+			s[i] = operand.String()
+		}
+	}
+	return strings.Join(s, sep)
+}
+
+// quoteQuery quotes s as a query STRING.
+func quoteQuery(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			b.WriteString(`\"`)
+		case s[i] == '\\' && (i+1 == len(s) || s[i+1] == '"' || s[i+1] == '\\'):
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// matchersQuery translates inc and exc matchers into a query. An event must
+// match any include and no exclude. It returns nil if there are no matchers.
+func matchersQuery(includes, excludes matchGroup) query {
+	var q queryAnd
+	if len(includes) > 0 {
+		q = append(q, matchGroupQuery(includes))
+	}
+	if len(excludes) > 0 {
+		q = append(q, queryNot{matchGroupQuery(excludes)})
+	}
+	switch len(q) {
+	case 0:
+		return nil
+	case 1:
+		return q[0]
+	}
+	return q
+}
+
+func matchGroupQuery(m matchGroup) query {
+	if len(m) == 1 {
+		return m[0]
+	}
+	q := make(queryOr, len(m))
+	for i, matcher := range m {
+		q[i] = matcher
+	}
+	return q
+}
+
+type queryError struct {
+	pos int
+	msg string
+}
+
+func (e queryError) Error() string {
+	return fmt.Sprintf("%s at character %d", e.msg, e.pos+1)
+}
+
+type queryTokenKind int
+
+const (
+	queryEOF queryTokenKind = iota
+	queryWord
+	queryString
+	queryOpen
+	queryClose
+	queryMatchOp
+	queryNotMatchOp
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	value string
+	pos   int
+}
+
+func (t queryToken) String() string {
+	if t.kind == queryEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.value)
+}
+
+func (t queryToken) keyword(keyword string) bool {
+	return t.kind == queryWord && strings.EqualFold(t.value, keyword)
+}
+
+func lexQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r':
+			i++
+		case s[i] == '(':
+			tokens = append(tokens, queryToken{kind: queryOpen, value: "(", pos: i})
+			i++
+		case s[i] == ')':
+			tokens = append(tokens, queryToken{kind: queryClose, value: ")", pos: i})
+			i++
+		case strings.HasPrefix(s[i:], "=~"):
+			tokens = append(tokens, queryToken{kind: queryMatchOp, value: "=~", pos: i})
+			i += 2
+		case strings.HasPrefix(s[i:], "!~"):
+			tokens = append(tokens, queryToken{kind: queryNotMatchOp, value: "!~", pos: i})
+			i += 2
+		case s[i] == '"':
+			var (
+				value strings.Builder
+				end   = -1
+			)
+			for j := i + 1; j < len(s); j++ {
+				if s[j] == '"' {
+					end = j
+					break
+				}
+				if strings.HasPrefix(s[j:], `\"`) || strings.HasPrefix(s[j:], `\\`) {
+					j++
+				}
+				value.WriteByte(s[j])
+			}
+			if end < 0 {
+				return nil, queryError{pos: i, msg: "unterminated string"}
+			}
+			tokens = append(tokens, queryToken{kind: queryString, value: value.String(), pos: i})
+			i = end + 1
+		case isQueryWordByte(s[i]):
+			start := i
+			for i < len(s) && isQueryWordByte(s[i]) {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: queryWord, value: s[start:i], pos: start})
+		default:
+			return nil, queryError{pos: i, msg: fmt.Sprintf("unexpected %q", s[i])}
+		}
+	}
+	return append(tokens, queryToken{kind: queryEOF, pos: len(s)}), nil
+}
+
+func isQueryWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '_' || b == ';' || b == '@'
+}
+
+type queryParser struct {
+	tokens []queryToken
+	// location is the time zone that time based pseudo-properties are
+	// evaluated in.
+	location *time.Location
+}
+
+// parseQuery parses a query expression, see query for the grammar. Time based
+// pseudo-properties are evaluated in loc.
+func parseQuery(s string, loc *time.Location) (query, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens, location: loc}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != queryEOF {
+		return nil, queryError{pos: next.pos, msg: fmt.Sprintf("expected AND, OR, or end of query, got %s", next)}
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[0]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[0]
+	if t.kind != queryEOF {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *queryParser) or() (query, error) {
+	q, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	operands := queryOr{q}
+	for p.peek().keyword("OR") {
+		p.next()
+		q, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, q)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *queryParser) and() (query, error) {
+	q, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	operands := queryAnd{q}
+	for p.peek().keyword("AND") {
+		p.next()
+		q, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, q)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+func (p *queryParser) not() (query, error) {
+	if p.peek().keyword("NOT") {
+		p.next()
+		q, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{q}, nil
+	}
+	return p.primary()
+}
+
+func (p *queryParser) primary() (query, error) {
+	t := p.next()
+	switch {
+	case t.kind == queryOpen:
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.next(); next.kind != queryClose {
+			return nil, queryError{pos: next.pos, msg: fmt.Sprintf("expected \")\", got %s", next)}
+		}
+		return q, nil
+	case t.kind == queryWord && !t.keyword("AND") && !t.keyword("OR") && !t.keyword("NOT"):
+		return p.comparison(t)
+	}
+	return nil, queryError{pos: t.pos, msg: fmt.Sprintf("expected field or \"(\", got %s", t)}
+}
+
+func (p *queryParser) comparison(field queryToken) (query, error) {
+	property, parameter, ok := parseField(field.value)
+	if !ok {
+		return nil, queryError{pos: field.pos, msg: fmt.Sprintf("expected field like PROPERTY or PROPERTY;PARAMETER, got %s", field)}
+	}
+	op := p.next()
+	if op.kind != queryMatchOp && op.kind != queryNotMatchOp {
+		return nil, queryError{pos: op.pos, msg: fmt.Sprintf("expected \"=~\" or \"!~\", got %s", op)}
+	}
+	value := p.next()
+	if value.kind != queryString {
+		return nil, queryError{pos: value.pos, msg: fmt.Sprintf("expected quoted regexp, got %s", value)}
+	}
+
+	var q query
+	if isTimeProperty(property) {
+		timeMatcher, err := parseTimeMatcher(property, value.value, p.location)
+		if err != nil {
+			return nil, queryError{pos: value.pos, msg: err.Error()}
+		}
+		q = timeMatcher
+	} else {
+		expression, err := regexp.Compile(value.value)
+		if err != nil {
+			return nil, queryError{pos: value.pos, msg: fmt.Sprintf("bad regexp: %s", err)}
+		}
+		m := matcher{
+			property:   property,
+			parameter:  parameter,
+			expression: expression,
+		}
+		if p.peek().keyword("FOR") {
+			forToken := p.next()
+			if parameter == "" {
+				return nil, queryError{pos: forToken.pos, msg: "FOR needs a field like PROPERTY;PARAMETER"}
+			}
+			instance := p.next()
+			if instance.kind != queryString {
+				return nil, queryError{pos: instance.pos, msg: fmt.Sprintf("expected quoted regexp, got %s", instance)}
+			}
+			m.instance, err = regexp.Compile(instance.value)
+			if err != nil {
+				return nil, queryError{pos: instance.pos, msg: fmt.Sprintf("bad regexp: %s", err)}
+			}
+		}
+		q = m
+	}
+	if op.kind == queryNotMatchOp {
+		q = queryNot{q}
+	}
+	return q, nil
+}
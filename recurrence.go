@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	"github.com/teambition/rrule-go"
+)
+
+const (
+	defaultRecurrencePast   = 90 * 24 * time.Hour
+	defaultRecurrenceFuture = 365 * 24 * time.Hour
+	defaultMaxRecurrences   = 1000
+
+	icalDate        = "20060102"
+	icalDateTime    = "20060102T150405"
+	icalDateTimeUTC = "20060102T150405Z"
+)
+
+// expandEvents replaces each recurring event with an event for each of its
+// occurrences that overlap the horizon from to to. Events with more than limit
+// occurrences in the horizon, or that fail to expand, are returned as is, as
+// are their modified occurrences. Otherwise modified occurrences replace the
+// occurrence they modify. Expanded events are given a UID unique to their
+// occurrence and no longer have recurrence properties. Events that don't recur
+// are returned as is.
+func expandEvents(ctx context.Context, events []*ics.VEvent, from, to time.Time, limit int) []*ics.VEvent {
+	overrides := make(map[string]map[int64]*ics.VEvent)
+	for _, event := range events {
+		recurrenceID := event.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId))
+		uid := event.GetProperty(ics.ComponentPropertyUniqueId)
+		if recurrenceID == nil || uid == nil {
+			continue
+		}
+		t, err := parseTimes(*recurrenceID)
+		if err != nil || len(t) != 1 {
+			log(ctx).Warnf("Invalid RECURRENCE-ID %q: %v", recurrenceID.Value, err)
+			continue
+		}
+		if overrides[uid.Value] == nil {
+			overrides[uid.Value] = make(map[int64]*ics.VEvent)
+		}
+		overrides[uid.Value][t[0].Unix()] = event
+	}
+
+	occurrences := make(map[*ics.VEvent][]*ics.VEvent)
+	notExpanded := make(map[string]bool)
+	for _, event := range events {
+		if event.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId)) != nil || !recurs(event) {
+			continue
+		}
+		eventOccurrences, err := expandEvent(event, from, to, limit)
+		if err != nil {
+			log(ctx).Warnf("Failed to expand recurring event, using it as is: %s", err)
+			if uid := event.GetProperty(ics.ComponentPropertyUniqueId); uid != nil {
+				notExpanded[uid.Value] = true
+			}
+			continue
+		}
+		occurrences[event] = eventOccurrences
+	}
+
+	var expanded []*ics.VEvent
+	for _, event := range events {
+		if recurrenceID := event.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId)); recurrenceID != nil {
+			// The overrides of an event used as is must be kept as is too,
+			// or they would duplicate the occurrences they modify.
+			if uid := event.GetProperty(ics.ComponentPropertyUniqueId); uid != nil && notExpanded[uid.Value] {
+				expanded = append(expanded, event)
+				continue
+			}
+			expanded = append(expanded, occurrence(event, *recurrenceID))
+			continue
+		}
+		eventOccurrences, ok := occurrences[event]
+		if !ok {
+			expanded = append(expanded, event)
+			continue
+		}
+
+		var eventOverrides map[int64]*ics.VEvent
+		if uid := event.GetProperty(ics.ComponentPropertyUniqueId); uid != nil {
+			eventOverrides = overrides[uid.Value]
+		}
+		for _, occurrence := range eventOccurrences {
+			start, _ := occurrence.GetStartAt()
+			if _, ok := eventOverrides[start.Unix()]; ok {
+				continue
+			}
+			expanded = append(expanded, occurrence)
+		}
+	}
+	return expanded
+}
+
+func recurs(event *ics.VEvent) bool {
+	return event.GetProperty(ics.ComponentPropertyRrule) != nil ||
+		event.GetProperty(ics.ComponentPropertyRdate) != nil
+}
+
+// expandEvent returns an event for each occurrence of event that overlaps the
+// horizon from to to, or an error if there are more than limit.
+func expandEvent(event *ics.VEvent, from, to time.Time, limit int) ([]*ics.VEvent, error) {
+	dtStart := event.GetProperty(ics.ComponentPropertyDtStart)
+	if dtStart == nil {
+		return nil, ics.ErrorPropertyNotFound
+	}
+	start, err := event.GetStartAt()
+	if err != nil {
+		return nil, err
+	}
+	var duration time.Duration
+	if end, err := event.GetEndAt(); err == nil {
+		duration = end.Sub(start)
+	}
+
+	set := &rrule.Set{}
+	set.DTStart(start)
+	set.RDate(start)
+	for _, property := range event.Properties {
+		switch ics.ComponentProperty(property.IANAToken) {
+		case ics.ComponentPropertyRrule:
+			options, err := rrule.StrToROptionInLocation(property.Value, start.Location())
+			if err != nil {
+				return nil, err
+			}
+			options.Dtstart = start
+			rule, err := rrule.NewRRule(*options)
+			if err != nil {
+				return nil, err
+			}
+			set.RRule(rule)
+		case ics.ComponentPropertyRdate:
+			times, err := parseTimes(property)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range times {
+				set.RDate(t)
+			}
+		case ics.ComponentPropertyExdate:
+			times, err := parseTimes(property)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range times {
+				set.ExDate(t)
+			}
+		}
+	}
+
+	var occurrences []*ics.VEvent
+	// occurrences that start before from may still overlap it
+	for _, t := range set.Between(from.Add(-max(duration, 0)), to, true) {
+		if !t.Before(to) || !t.Add(duration).After(from) && !t.Equal(from) {
+			continue
+		}
+		if len(occurrences) == limit {
+			return nil, fmt.Errorf("more than %d occurrences between %s and %s", limit, from, to)
+		}
+		occurrences = append(occurrences, occurrence(event, timeProperty(*dtStart, t)))
+	}
+	return occurrences, nil
+}
+
+// occurrence returns a copy of event as a single occurrence starting at
+// recurrenceID, which must be a DTSTART or RECURRENCE-ID property. DTEND is
+// moved to keep the event's duration and the UID is made unique to the
+// occurrence.
+func occurrence(event *ics.VEvent, recurrenceID ics.IANAProperty) *ics.VEvent {
+	occurrence := cloneEvent(event)
+
+	recurrenceStart, _ := parseTimes(recurrenceID)
+	if recurrenceID.IANAToken == string(ics.ComponentPropertyDtStart) && len(recurrenceStart) == 1 {
+		start, startErr := event.GetStartAt()
+		end, endErr := event.GetEndAt()
+		setTimeProperty(occurrence, timeProperty(recurrenceID, recurrenceStart[0]))
+		if startErr == nil && endErr == nil {
+			dtEnd := event.GetProperty(ics.ComponentPropertyDtEnd)
+			setTimeProperty(occurrence, timeProperty(*dtEnd, recurrenceStart[0].Add(end.Sub(start))))
+		}
+	}
+
+	if uid := event.GetProperty(ics.ComponentPropertyUniqueId); uid != nil && len(recurrenceStart) == 1 {
+		suffix := recurrenceStart[0].UTC().Format(icalDateTimeUTC)
+		if len(recurrenceID.Value) == len(icalDate) {
+			suffix = recurrenceStart[0].Format(icalDate)
+		}
+		occurrence.SetProperty(ics.ComponentPropertyUniqueId, uid.Value+"-"+suffix)
+	}
+
+	occurrence.Properties = slices.DeleteFunc(occurrence.Properties, func(property ics.IANAProperty) bool {
+		switch ics.ComponentProperty(property.IANAToken) {
+		case ics.ComponentPropertyRrule,
+			ics.ComponentPropertyRdate,
+			ics.ComponentPropertyExdate,
+			ics.ComponentProperty(ics.PropertyRecurrenceId):
+			return true
+		}
+		return false
+	})
+	return occurrence
+}
+
+// parseTimes parses the comma separated date or date-time values of a
+// property, using its TZID and VALUE parameters.
+func parseTimes(property ics.IANAProperty) ([]time.Time, error) {
+	var times []time.Time
+	for _, value := range strings.Split(property.Value, ",") {
+		// Reuse the library's parsing of DTSTART for every value.
+		component := ics.ComponentBase{
+			Properties: []ics.IANAProperty{{
+				BaseProperty: ics.BaseProperty{
+					IANAToken:      string(ics.ComponentPropertyDtStart),
+					ICalParameters: property.ICalParameters,
+					Value:          value,
+				},
+			}},
+		}
+		t, err := component.GetStartAt()
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// timeProperty returns a copy of like with its value set to t, in the same
+// format as like.
+func timeProperty(like ics.IANAProperty, t time.Time) ics.IANAProperty {
+	property := like
+	property.ICalParameters = maps.Clone(like.ICalParameters)
+	switch {
+	case len(like.Value) == len(icalDate):
+		property.Value = t.Format(icalDate)
+	case strings.HasSuffix(like.Value, "Z"):
+		property.Value = t.UTC().Format(icalDateTimeUTC)
+	default:
+		property.Value = t.Format(icalDateTime)
+	}
+	return property
+}
+
+// setTimeProperty replaces the event's property of the same name.
+func setTimeProperty(event *ics.VEvent, property ics.IANAProperty) {
+	for i := range event.Properties {
+		if event.Properties[i].IANAToken == property.IANAToken {
+			event.Properties[i] = property
+			return
+		}
+	}
+}
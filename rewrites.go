@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+type Rewrite struct {
+	Property, Regex, Replacement string
+}
+
+// rewrite replaces matches of expression in a property with replacement, which
+// may refer to capture groups as in regexp.Regexp.Expand.
+type rewrite struct {
+	matcher
+	replacement string
+}
+
+func (r rewrite) Rewrite() Rewrite {
+	return Rewrite{
+		Property:    r.field(),
+		Regex:       r.expression.String(),
+		Replacement: r.replacement,
+	}
+}
+
+type rewrites []rewrite
+
+func parseRewrites(rws []string) (rewrites, error) {
+	rewrites := make(rewrites, 0, len(rws))
+	for i, rw := range rws {
+		parts := strings.SplitN(rw, "=", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid rewrite parameter %q at index %d, should be <FIELD>=<regexp>=<replacement>", rw, i)
+		}
+		property, parameter, ok := parseField(parts[0])
+		if !ok || isTimeProperty(property) {
+			return nil, fmt.Errorf("invalid field %q in rewrite parameter at index %d, should be <PROPERTY> or <PROPERTY>;<PARAMETER>", parts[0], i)
+		}
+		expression, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp in rewrite parameter %s at index %d: %w", rw, i, err)
+		}
+		rewrites = append(rewrites, rewrite{
+			matcher: matcher{
+				property:   property,
+				parameter:  parameter,
+				expression: expression,
+			},
+			replacement: parts[2],
+		})
+	}
+	return rewrites, nil
+}
+
+// apply rewrites every instance of each rewrite's property of event, in order.
+func (r rewrites) apply(event *ics.VEvent) {
+	for _, rw := range r {
+		for i := range event.Properties {
+			property := &event.Properties[i]
+			if !strings.EqualFold(property.IANAToken, string(rw.property)) {
+				continue
+			}
+			if rw.parameter == "" {
+				property.Value = rw.expression.ReplaceAllString(property.Value, rw.replacement)
+				continue
+			}
+			for key, values := range property.ICalParameters {
+				if !strings.EqualFold(key, rw.parameter) {
+					continue
+				}
+				// cloneEvent doesn't copy the values.
+				rewritten := make([]string, len(values))
+				for j, value := range values {
+					rewritten[j] = rw.expression.ReplaceAllString(value, rw.replacement)
+				}
+				property.ICalParameters[key] = rewritten
+			}
+		}
+	}
+}
@@ -1,19 +1,26 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"html/template"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/brackendawson/webcal-proxy/assets"
-	"github.com/brackendawson/webcal-proxy/cache"
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	defaultMaxConns = 8
+	defaultMaxConns    = 8
+	defaultCacheMaxAge = time.Hour
 )
 
 var (
@@ -31,36 +38,184 @@ func MaxConns(c int) Opt {
 	}
 }
 
+// UpstreamCacheSize sets the maximum number of upstream calendars kept in
+// memory for conditional requests. The default is 64, 0 disables the cache.
+func UpstreamCacheSize(n int) Opt {
+	return func(s *Server) {
+		s.upstreamCache = newUpstreamCache(n)
+	}
+}
+
+// UpstreamMaxAge sets how long a cached upstream calendar is used for before it
+// is revalidated, unless the upstream sets this with its Cache-Control or
+// Expires header. The default is 1 minute.
+func UpstreamMaxAge(d time.Duration) Opt {
+	return func(s *Server) {
+		s.upstreamMaxAge = d
+	}
+}
+
+// StaleWhileRevalidate sets how long after a cached upstream calendar needs
+// revalidating it can still be used without waiting for it to be
+// revalidated, it is then revalidated in the background. The default is 5
+// minutes, 0 always waits.
+func StaleWhileRevalidate(d time.Duration) Opt {
+	return func(s *Server) {
+		s.staleWhileRevalidate = d
+	}
+}
+
+// MaxStale sets how old a cached upstream calendar can be and still be used
+// when the upstream cannot be fetched. The default is 24 hours, 0 never uses a
+// calendar that could not be revalidated.
+func MaxStale(d time.Duration) Opt {
+	return func(s *Server) {
+		s.maxStale = d
+	}
+}
+
+// CacheKey sets the key used to sign the calendars cached by browsers. Servers
+// behind the same load balancer should use the same key. The default is a
+// random key.
+func CacheKey(key []byte) Opt {
+	return func(s *Server) {
+		s.cacheKey = key
+	}
+}
+
+// CacheMaxAge sets how long a calendar cached by a browser can be used for
+// before it must be fetched again. The default is 1 hour.
+func CacheMaxAge(d time.Duration) Opt {
+	return func(s *Server) {
+		s.cacheMaxAge = d
+	}
+}
+
+// RecurrenceHorizon sets how far before and after now recurring events are
+// expanded into their occurrences in calendar feeds. The default is 90 days
+// before and 365 days after.
+func RecurrenceHorizon(past, future time.Duration) Opt {
+	return func(s *Server) {
+		s.recurrencePast = past
+		s.recurrenceFuture = future
+	}
+}
+
+// MaxRecurrences sets the maximum number of occurrences a recurring event is
+// expanded into, events with more are served as they are. The default is 1000.
+func MaxRecurrences(n int) Opt {
+	return func(s *Server) {
+		s.maxRecurrences = n
+	}
+}
+
+// MetricsPath sets a path on the server's router to serve its Prometheus
+// metrics on. The default is the empty string, which doesn't serve them so
+// that MetricsHandler can be served on a listener that isn't public.
+func MetricsPath(p string) Opt {
+	return func(s *Server) {
+		s.metricsPath = p
+	}
+}
+
+// MetricsHosts sets the upstream hosts that the upstream fetch metrics are
+// labelled with, fetches from any other host are labelled other. The default
+// labels every fetch other.
+func MetricsHosts(hosts ...string) Opt {
+	return func(s *Server) {
+		s.metrics.hosts = nil
+		for _, host := range hosts {
+			s.metrics.hosts = append(s.metrics.hosts, strings.TrimSuffix(strings.ToLower(host), "."))
+		}
+	}
+}
+
 type Server struct {
-	client    *http.Client
-	semaphore chan struct{}
+	client        *http.Client
+	policy        HostPolicy
+	semaphore     chan struct{}
+	upstreamCache *upstreamCache
+	inflight      *inflightFetches
+
+	upstreamMaxAge       time.Duration
+	staleWhileRevalidate time.Duration
+	maxStale             time.Duration
+
+	cacheKey    []byte
+	cacheMaxAge time.Duration
+
+	recurrencePast   time.Duration
+	recurrenceFuture time.Duration
+	maxRecurrences   int
+
+	metrics     *metrics
+	metricsPath string
+
+	draining atomic.Bool
+	// closed is done once the server is closed, cancelling upstream fetches.
+	closed context.Context
+	close  context.CancelFunc
+	// lastConnChange is when an upstream connection was last taken or
+	// released, in Unix nanoseconds.
+	lastConnChange atomic.Int64
 
 	now func() time.Time
 }
 
 func New(r *gin.Engine, opts ...Opt) *Server {
 	s := &Server{
-		client: &http.Client{
-			Timeout: requestTimeoutSecs * time.Second,
-			Transport: &WithUserAgent{
-				RoundTripper: &http.Transport{
-					DialContext: publicUnicastOnlyDialContext,
+		semaphore:     make(chan struct{}, defaultMaxConns),
+		upstreamCache: newUpstreamCache(defaultUpstreamCacheSize),
+		inflight:      newInflightFetches(),
+
+		upstreamMaxAge:       defaultUpstreamMaxAge,
+		staleWhileRevalidate: defaultStaleWhileRevalidate,
+		maxStale:             defaultMaxStale,
+
+		cacheKey:    make([]byte, 32),
+		cacheMaxAge: defaultCacheMaxAge,
+
+		recurrencePast:   defaultRecurrencePast,
+		recurrenceFuture: defaultRecurrenceFuture,
+		maxRecurrences:   defaultMaxRecurrences,
+
+		now: time.Now,
+	}
+	s.client = &http.Client{
+		Timeout: requestTimeoutSecs * time.Second,
+		Transport: &WithUserAgent{
+			RoundTripper: &http.Transport{
+				// the policy may be set after the client by UpstreamPolicy
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return s.policy.dialContext(ctx, network, addr)
 				},
-				UserAgent: fmt.Sprintf("%s/%s", serverName, serverVersion),
 			},
+			UserAgent: fmt.Sprintf("%s/%s", serverName, serverVersion),
 		},
-		semaphore: make(chan struct{}, defaultMaxConns),
-		now:       time.Now,
+	}
+	s.metrics = newMetrics(s)
+	s.closed, s.close = context.WithCancel(context.Background())
+
+	if _, err := rand.Read(s.cacheKey); err != nil {
+		panic(fmt.Sprintf("failed to generate cache key: %s", err))
 	}
 
 	r.ContextWithFallback = true
-	r.Use(logging)
+	r.Use(logging, s.metrics.middleware)
 
-	r.SetHTMLTemplate(assets.Templates())
+	r.SetHTMLTemplate(assets.Templates(template.FuncMap{
+		"encodeCache": s.encodeCache,
+	}))
+	r.GET("/healthz", s.HandleHealthz)
+	r.GET("/readyz", s.HandleReadyz)
 	r.GET("/", s.HandleWebcal)
 	r.POST("/", s.HandleHTMX)
 	r.GET("/matcher", s.HandleMatcher)
 	r.DELETE("/matcher", s.HandleMatcherDelete)
+	r.GET("/rewrite", s.HandleRewrite)
+	r.DELETE("/rewrite", s.HandleRewriteDelete)
+	r.GET("/source", s.HandleSource)
+	r.DELETE("/source", s.HandleSourceDelete)
 	r.GET("/date-picker-month", s.HandleDatePickerMonth)
 	r.StaticFS("/assets", http.FS(assets.Assets))
 
@@ -68,9 +223,21 @@ func New(r *gin.Engine, opts ...Opt) *Server {
 		opt(s)
 	}
 
+	if s.metricsPath != "" {
+		r.GET(s.metricsPath, gin.WrapH(s.MetricsHandler()))
+	}
+
 	return s
 }
 
+// Close cancels every upstream fetch, including background revalidations, so
+// that requests waiting for them fail rather than keep the server from
+// shutting down. Upstream calendars can't be fetched after the server is
+// closed.
+func (s *Server) Close() {
+	s.close()
+}
+
 type View struct {
 	ArgHost, ArgProxyPath string
 }
@@ -101,11 +268,11 @@ type Index struct {
 	Error   string
 }
 
-func newIndex(c *gin.Context) Index {
+func newIndex(c *gin.Context, now time.Time) Index {
 	i := Index{
 		View: newView(c),
 	}
-	opts, err := getCalendarOptions(c, c.QueryArray)
+	opts, err := getCalendarOptions(c, c.QueryArray, now)
 	if err != nil {
 		i.Error = err.Error() + " Enter your webcal URL."
 		return i
@@ -115,17 +282,19 @@ func newIndex(c *gin.Context) Index {
 }
 
 func (s *Server) HandleWebcal(c *gin.Context) {
-	if isBrowser(c) {
-		c.HTML(http.StatusOK, "index", newIndex(c))
+	mediaType := negotiate(c.GetHeader("Accept"), webcalMediaTypes)
+	if mediaType == mediaTypeHTML {
+		c.HTML(http.StatusOK, "index", newIndex(c, s.now()))
 		return
 	}
 
-	opts, err := getCalendarOptions(c, c.QueryArray)
+	now := s.now()
+	opts, err := getCalendarOptions(c, c.QueryArray, now)
 	if err != nil {
 		handleWebcalErr(c, err)
 		return
 	}
-	if opts.url == "" {
+	if len(opts.sources) == 0 {
 		handleWebcalErr(c, newErrorWithMessage(
 			http.StatusBadRequest,
 			`Missing "cal" parameter, must be a webcal URL.`,
@@ -133,16 +302,55 @@ func (s *Server) HandleWebcal(c *gin.Context) {
 		return
 	}
 
-	upstream, err := s.getUpstreamCalendar(c, opts.url)
+	// gin reuses its Context after the handler returns, but the HTTP client
+	// may still hold the context, so give it the request's context.
+	upstreams, err := s.getUpstreamCalendars(c.Request.Context(), opts.sources, nil)
 	if err != nil {
 		handleWebcalErr(c, err)
 		return
 	}
 
-	downstream := getDownstreamCalendar(upstream, opts)
+	format := opts.format
+	if format == "" {
+		// Calendar clients send all sorts of Accept headers, serve iCal
+		// unless they asked for something else.
+		format = mediaTypeFormats[mediaType]
+	}
 
-	c.Header("Content-Type", "text/calendar")
-	_ = downstream.SerializeTo(c.Writer)
+	opts.expand = opts.needsOccurrences(format)
+	opts.from, opts.to = opts.window.horizon(now.Add(-s.recurrencePast), now.Add(s.recurrenceFuture))
+	downstream := s.getDownstreamCalendar(c, upstreams, opts)
+
+	setUpstreamHeaders(c, upstreams)
+	switch format {
+	case "freebusy":
+		c.Header("Content-Type", mediaTypeICal)
+		_ = freeBusy(downstream, opts.sources, opts.from, opts.to, now).SerializeTo(c.Writer)
+	case "jcal":
+		c.Header("Content-Type", mediaTypeJCal)
+		_ = json.NewEncoder(c.Writer).Encode(jCal(downstream))
+	case "json":
+		c.Header("Content-Type", mediaTypeJSON)
+		_ = json.NewEncoder(c.Writer).Encode(jsonEvents(downstream))
+	case "csv":
+		c.Header("Content-Type", mediaTypeCSV)
+		c.Header("Content-Disposition", `attachment; filename="calendar.csv"`)
+		_ = writeCSV(c.Writer, downstream, opts.csvColumns, opts.location, opts.split)
+	case "atom":
+		limit := opts.limit
+		if limit == 0 {
+			limit = defaultFeedLimit
+		}
+		c.Header("Content-Type", mediaTypeAtom)
+		_, _ = c.Writer.WriteString(xml.Header)
+		_ = xml.NewEncoder(c.Writer).Encode(atom(downstream, opts.sources, limit, now, opts.location))
+	case "xcal":
+		c.Header("Content-Type", mediaTypeXCal)
+		_ = writeXCal(c.Writer, downstream)
+	default:
+		c.Header("Content-Type", mediaTypeICal)
+		_ = downstream.SerializeTo(c.Writer)
+	}
 }
 
 func (s *Server) HandleHTMX(c *gin.Context) {
@@ -162,48 +370,36 @@ func (s *Server) HandleHTMX(c *gin.Context) {
 	}
 	log(c).Debugf("Using target: %s", target)
 
-	opts, err := getCalendarOptions(c, c.PostFormArray)
+	opts, err := getCalendarOptions(c, c.PostFormArray, today)
 	if err != nil {
 		handleHTMXError(c, newMonth(c, newView(c), target, today, nil), err)
 		return
 	}
 
-	if opts.url == "" {
+	if len(opts.sources) == 0 {
 		c.HTML(http.StatusOK, "calendar", newMonth(c, newView(c), target, today, nil))
 		return
 	}
 
-	upstream, upstreamFromCache, err := s.getUpstreamWithCache(c, opts.url, c.PostForm("ical-cache"))
+	upstreams, err := s.getUpstreamCalendars(c.Request.Context(), opts.sources, c.PostFormArray("ical-cache"))
 	if err != nil {
 		handleHTMXError(c, newMonth(c, newView(c), target, today, nil), err)
 		return
 	}
 
-	downstream := getDownstreamCalendar(upstream, opts)
+	opts.expand = true
+	opts.from, opts.to = monthRange(target)
+	downstream := s.getDownstreamCalendar(c, upstreams, opts)
 
 	calendar := newMonth(c, newView(c), target, today, downstream)
+	calendar.Caches = browserCaches(upstreams)
+	calendar.Warnings = upstreamWarnings(upstreams)
 
-	if upstream != nil && !upstreamFromCache {
-		calendar.Cache = &cache.Webcal{
-			URL:      opts.url,
-			Calendar: upstream,
-		}
-	}
-
-	calendar.URL = clientURL(c).String()
+	calendar.URL = clientURL(c, opts.sources).String()
 
 	c.HTML(http.StatusOK, "calendar", calendar)
 }
 
-func isBrowser(c *gin.Context) bool {
-	for _, mediaType := range strings.Split(c.GetHeader("Accept"), ",") {
-		if mediaType == "text/html" {
-			return true
-		}
-	}
-	return false
-}
-
 func parseTarget(c *gin.Context, today time.Time) (time.Time, bool) {
 	targetYear := c.PostForm("target-year")
 	if targetYear == "" {
@@ -240,6 +436,24 @@ func (s *Server) HandleMatcherDelete(c *gin.Context) {
 	triggerFormSubmit(c)
 }
 
+func (s *Server) HandleRewrite(c *gin.Context) {
+	c.HTML(http.StatusOK, "template-rewrite-group", newView(c))
+}
+
+func (s *Server) HandleRewriteDelete(c *gin.Context) {
+	// See HandleMatcherDelete.
+	triggerFormSubmit(c)
+}
+
+func (s *Server) HandleSource(c *gin.Context) {
+	c.HTML(http.StatusOK, "template-source-group", newView(c))
+}
+
+func (s *Server) HandleSourceDelete(c *gin.Context) {
+	// See HandleMatcherDelete.
+	triggerFormSubmit(c)
+}
+
 type Picker struct {
 	View
 	Target, Now time.Time
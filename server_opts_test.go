@@ -18,3 +18,15 @@ func WithClock(f func() time.Time) Opt {
 		s.now = f
 	}
 }
+
+// InflightWaiters returns the number of requests waiting for in-flight
+// upstream fetches.
+func (s *Server) InflightWaiters() int {
+	s.inflight.mu.Lock()
+	defer s.inflight.mu.Unlock()
+	var waiters int
+	for _, call := range s.inflight.fetches {
+		waiters += call.waiters
+	}
+	return waiters
+}
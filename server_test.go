@@ -2,10 +2,17 @@ package server_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -33,6 +40,8 @@ func TestServer(t *testing.T) {
 		inputHeaders map[string]string
 		inputBody    []byte
 		inputCache   *cache.Webcal
+		// inputCacheKey signs inputCache, the default is testCacheKey
+		inputCacheKey []byte
 
 		// server settings
 		serverOpts []server.Opt
@@ -44,9 +53,12 @@ func TestServer(t *testing.T) {
 		expectedStatus       int
 		expectedCalendar     []byte
 		expectedBody         *[]byte
+		expectedJSON         []byte
 		expectedTemplateName string
 		expectedTemplateObj  any
 		expectedHeaders      map[string]string
+		// unexpectedInBody must not appear anywhere in the body
+		unexpectedInBody []string
 	}{
 		"default": {
 			inputMethod: http.MethodGet,
@@ -128,6 +140,380 @@ func TestServer(t *testing.T) {
 			expectedStatus: http.StatusBadGateway,
 			expectedBody:   ptrTo([]byte("Failed to fetch calendar")),
 		},
+		"multiple_calendars": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL/events&cal=http://CALURL/holidays",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServers(map[string]http.HandlerFunc{"/events": mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024), "/holidays": mockWebcalServer(http.StatusOK, nil, fixtures.Holidays2024)}),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.EventsAndHolidays2024,
+		},
+		"multiple_calendars_labelled": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL/events&cal=http://CALURL/holidays&lbl=&lbl=Holiday:&cat=&cat=Holidays&col=&col=Green",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServers(map[string]http.HandlerFunc{"/events": mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024), "/holidays": mockWebcalServer(http.StatusOK, nil, fixtures.Holidays2024)}),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.EventsAndLabelledHolidays2024,
+		},
+		"bad_colour": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&col=light%20blue",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "light blue" for "col", should be a CSS colour name.`)),
+		},
+		"unknown_colour": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&col=fooo",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "fooo" for "col", should be a CSS colour name.`)),
+		},
+		"multiple_calendars_one_not_working": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL/events&cal=http://CALURL/holidays",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServers(map[string]http.HandlerFunc{"/events": mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024), "/holidays": mockWebcalServer(http.StatusInternalServerError, nil, nil)}),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+			expectedHeaders:  map[string]string{"Warning": `199 - "Failed to fetch calendar http://CALURL/holidays"`},
+		},
+		"multiple_calendars_none_working": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL/events&cal=http://CALURL/holidays",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusInternalServerError, nil, nil),
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   ptrTo([]byte("Failed to fetch calendar")),
+		},
+		"multiple_calendars_one_bad_url": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL/events&cal=ftp://CALURL/holidays",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte("Unsupported protocol scheme, url should be webcal, https, or http.")),
+		},
+		"recurring_events_not_expanded": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Recurring),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Recurring,
+		},
+		"recurring_events": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&inc=SUMMARY=.",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.RecurrenceHorizon(15*24*time.Hour, 10*24*time.Hour),
+				server.MaxRecurrences(3),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Recurring),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.RecurringExpanded,
+		},
+		"recurring_events_filtered_per_occurrence": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&inc=SUMMARY=moved",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Recurring),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.RecurringOnlyMoved,
+		},
+		"recurring_events_over_limit_keep_overrides": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&inc=SUMMARY=Standup",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.MaxRecurrences(2),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Recurring),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.RecurringStandupNotExpanded,
+		},
+		"recurring_events_started_long_ago": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&from=2024-09-11T09:00:00Z&to=2024-09-11T12:00:00Z",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.RecurringHourly),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.RecurringHourlyExpanded,
+		},
+		"window_absolute_from_relative_to": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&from=2024-09-11&to=%2B14d",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 6, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024OnlyPicnic,
+		},
+		"window_unescaped_plus": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&from=2024-09-11&to=+14d",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 6, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024OnlyPicnic,
+		},
+		"window_relative": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "?cal=http://CALURL&from=-1d&to=2w",
+			serverOpts: []server.Opt{
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 6, 0, 0, 0, time.UTC) }),
+			},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024WithoutBirthday,
+		},
+		"bad_window": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&to=soon",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "soon" for "to", should be a date like 2024-09-11 or a number of days from now like -30d.`)),
+		},
+		"bad_format": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=pdf",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "pdf" for "fmt", should be one of ical, freebusy, jcal, json, csv, atom, xcal.`)),
+		},
+		"jcal": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			inputHeaders:   map[string]string{"Accept": "application/calendar+json"},
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/calendar+json",
+			},
+			expectedJSON: fixtures.Events11Sept2024JCal,
+		},
+		"json_by_quality": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			inputHeaders:   map[string]string{"Accept": "text/calendar;q=0.5, application/*;q=0.1, application/json"},
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+			expectedJSON: fixtures.Events11Sept2024Events,
+		},
+		"json_by_fmt": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=json",
+			inputHeaders:   map[string]string{"Accept": "*/*"},
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+			expectedJSON: fixtures.Events11Sept2024Events,
+		},
+		"json_all_day_without_value_type": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=json",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.AllDayEventWithoutValue),
+			expectedStatus: http.StatusOK,
+			expectedJSON:   fixtures.AllDayEventEvents,
+		},
+		"json_end_from_duration": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=json",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.DurationEvents),
+			expectedStatus: http.StatusOK,
+			expectedJSON:   fixtures.DurationEventsEvents,
+		},
+		"ical_if_nothing_acceptable": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			inputHeaders:     map[string]string{"Accept": "image/png"},
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+		},
+		"xcal": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=xcal",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/calendar+xml",
+			},
+			expectedBody: &fixtures.Events11Sept2024XCal,
+		},
+		"xcal_upstream": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "application/calendar+xml"}, fixtures.Events11Sept2024XCal),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+		},
+		"xcal_upstream_sniffed": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.MeetingsXCal),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Meetings,
+		},
+		"bad_xcal_upstream": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "text/xml"}, []byte("<html><body>Not a calendar</body></html>")),
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   ptrTo([]byte("Failed to fetch calendar")),
+		},
+		"jcal_upstream": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "application/calendar+json"}, fixtures.Events11Sept2024JCal),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+		},
+		"jcal_upstream_values": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "application/json; charset=utf-8"}, fixtures.StandupJCal),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Standup,
+		},
+		"jcal_upstream_sniffed": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "application/octet-stream"}, fixtures.StandupJCal),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Standup,
+		},
+		"ical_upstream_sniffed": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "text/plain"}, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+		},
+		"unsupported_upstream": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "application/pdf"}, []byte("%PDF-1.7")),
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   ptrTo([]byte(`Unsupported calendar format "application/pdf", should be iCal, jCal, or xCal`)),
+		},
+		"html_upstream_sniffed": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "text/html; charset=utf-8"}, fixtures.Events11Sept2024),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Events11Sept2024,
+		},
+		"html_upstream": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, map[string]string{"Content-Type": "text/html; charset=utf-8"}, []byte("<html><body>Please log in</body></html>")),
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   ptrTo([]byte(`Unsupported calendar format "text/html", should be iCal, jCal, or xCal`)),
+		},
+		"csv_split_days": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=csv&tz=Europe%2FLondon&split=true&cols=SUMMARY,DTSTART,DTEND,DTSTAMP",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Shifts),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type":        "text/csv",
+				"Content-Disposition": `attachment; filename="calendar.csv"`,
+			},
+			expectedBody: ptrTo([]byte(`SUMMARY,DTSTART,DTEND,DTSTAMP
+Day shift,2024-09-09 09:00:00,2024-09-09 17:00:00,2024-09-01 10:00:00
+Night shift,2024-09-09 17:00:00,2024-09-10 00:00:00,2024-09-01 10:00:00
+Night shift,2024-09-10 00:00:00,2024-09-10 09:00:00,2024-09-01 10:00:00
+Handover,2024-09-10 12:00:00,2024-09-10 12:10:00,2024-09-01 10:00:00
+Weekend shift,2024-09-14 09:00:00,2024-09-14 17:00:00,2024-09-01 10:00:00
+`)),
+		},
+		"csv_default_columns": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL",
+			inputHeaders:   map[string]string{"Accept": "text/csv"},
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Content-Type": "text/csv",
+			},
+			expectedBody: ptrTo([]byte(`DTSTART,DTEND,SUMMARY,LOCATION,DESCRIPTION
+2024-09-10 11:00:00,2024-09-10 11:00:00,Meeting,Office,Take notes
+2024-09-11 11:00:00,2024-09-11 12:00:00,Picnic,Park,
+2024-10-02,2024-10-03,Barbie's birthday,,bring cake
+`)),
+		},
+		"csv_escapes_formulas": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=csv&cols=SUMMARY,DESCRIPTION",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer: mockWebcalServer(http.StatusOK, nil, fixtures.Formulas),
+			expectedStatus: http.StatusOK,
+			expectedBody: ptrTo([]byte("SUMMARY,DESCRIPTION\n" +
+				"'=1+2,Lunch\n" +
+				"'+44 call,'@channel join\n" +
+				"'-5 degrees party,'\tbring a coat\n" +
+				"Plain,1+2=3\n")),
+		},
+		"bad_cols": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=csv&cols=SUMMARY,,DTSTART",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad cols argument: invalid field "" at index 1, should be <PROPERTY> or <PROPERTY>;<PARAMETER>`)),
+		},
+		"bad_limit": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&fmt=atom&limit=0",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "0" for "limit", should be a positive number.`)),
+		},
 		"no-cal": {
 			inputMethod:    http.MethodGet,
 			inputQuery:     "?not=right",
@@ -138,27 +524,247 @@ func TestServer(t *testing.T) {
 		},
 		"includeRotation": {
 			inputMethod:      http.MethodGet,
-			inputQuery:       "?cal=http://CALURL&inc=SUMMARY=Rotation",
+			inputQuery:       "?cal=http://CALURL&inc=SUMMARY=Rotation",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalOnlyRotation,
+		},
+		"includeUnsetProperty": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&inc=LOCATION=Rotation",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalExampleEmpty,
+		},
+		"excludeSecondary": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&exc=SUMMARY=Secondary",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalWithoutSecondary,
+		},
+		"query": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&q=" + url.QueryEscape(`DTSTART =~ "202205\d\dT" AND NOT (summary =~ "Rotation" OR LOCATION =~ "Nowhere")`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalMay22NotRotation,
+		},
+		"query_not_match": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&q=" + url.QueryEscape(`SUMMARY !~ "Secondary"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalWithoutSecondary,
+		},
+		"query_and_exclude": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&exc=SUMMARY=Rotation&q=" + url.QueryEscape(`DTSTART =~ "202205\d\dT"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.CalMay22NotRotation,
+		},
+		"query_unclosed_parenthesis": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&q=" + url.QueryEscape(`(SUMMARY =~ "a" OR SUMMARY =~ "b"`),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad q argument: expected ")", got end of query at character 34`)),
+		},
+		"query_missing_operator": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&q=" + url.QueryEscape(`SUMMARY =~ "a" AND LOCATION "b"`),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad q argument: expected "=~" or "!~", got "b" at character 29`)),
+		},
+		"query_bad_regexp": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&q=" + url.QueryEscape(`SUMMARY =~ "a\"("`),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte("Bad q argument: bad regexp: error parsing regexp: missing closing ): `a\"(` at character 12")),
+		},
+		"query_escaped_backslash": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&q=" + url.QueryEscape(`SUMMARY =~ "a\\" OR SUMMARY =~ "b"`),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte("Bad q argument: bad regexp: error parsing regexp: trailing backslash at end of expression: `` at character 12")),
+		},
+		"exclude_parameter_of_any_instance": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&exc=ATTENDEE%3BPARTSTAT=DECLINED",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsNotDeclined,
+		},
+		"exclude_parameter_for_instance": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&exc=" + url.QueryEscape(`ATTENDEE;PARTSTAT=DECLINED=^mailto:me@example\.com$`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsNotDeclinedByMe,
+		},
+		"query_parameter_for_instance": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&q=" + url.QueryEscape(`ATTENDEE;PARTSTAT !~ "DECLINED" FOR "^mailto:me@example\.com$"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsNotDeclinedByMe,
+		},
+		"bad_for_without_parameter": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&exc=" + url.QueryEscape("ATTENDEE=bob=me"),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad exc argument: invalid match parameter "ATTENDEE=bob=me" at index 0, only a <PROPERTY>;<PARAMETER> field can be limited to the instances whose value matches a regexp`)),
+		},
+		"include_parameter": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&inc=organizer%3Bcn=Alice",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsOnlyRetro,
+		},
+		"query_parameter": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&q=" + url.QueryEscape(`DTSTART;TZID =~ "^America/" AND ATTENDEE !~ "bob"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsOnlyRetro,
+		},
+		"query_bad_field": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&q=" + url.QueryEscape(`ATTENDEE;CN;PARTSTAT =~ "DECLINED"`),
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad q argument: expected field like PROPERTY or PROPERTY;PARAMETER, got "ATTENDEE;CN;PARTSTAT" at character 1`)),
+		},
+		"include_start_time_in_time_zone": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&inc=@START=17:00-09:00&tz=Europe/London",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Shifts),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.ShiftsOutOfHours,
+		},
+		"include_all_day_weekday_in_time_zone": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&tz=America/New_York&q=" + url.QueryEscape(`@WEEKDAY =~ "^Monday$" AND @START =~ "00:00-00:01"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.AllDayEvent),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.AllDayEvent,
+		},
+		"exclude_short_duration": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&exc=@DURATION=%3C15m",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Shifts),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.ShiftsWithoutHandover,
+		},
+		"query_weekday_or_start_time": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&tz=Europe/London&q=" + url.QueryEscape(`@weekday =~ "^S" OR @START =~ "17:00-09:00"`),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Shifts),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.ShiftsOvertime,
+		},
+		"bad_time_range": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&inc=@START=9-5",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad inc argument: bad match parameter @START=9-5 at index 0: bad time range "9-5", should be like 09:00-17:00`)),
+		},
+		"bad_time_zone": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&inc=@START=09:00-17:00&tz=Mars/Olympus_Mons",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad argument "Mars/Olympus_Mons" for "tz", should be a time zone like Europe/London.`)),
+		},
+		"rewrite": {
+			inputMethod: http.MethodGet,
+			inputQuery: "?cal=http://CALURL&" + url.Values{"rw": []string{
+				`SUMMARY=\s*\[[A-Z]+-\d+\]$=`,
+				`summary=^On Call - 24x7$=🔔 On call`,
+				`LOCATION=^Room (\d+)$=Meeting room $1`,
+				`ATTENDEE;CN=^(\w+) .*=$1`,
+			}}.Encode(),
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Rewrite),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.Rewritten,
+		},
+		"rewrite_after_filter": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&inc=SUMMARY=OPS&rw=SUMMARY=OPS=WEB",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Rewrite),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: []byte("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//webcal-proxy//rewrites//EN\r\nBEGIN:VEVENT\r\nUID:oncall@example.com\r\nDTSTAMP:20240901T090000Z\r\nDTSTART:20240909T090000Z\r\nDTEND:20240909T235900Z\r\nSUMMARY:On Call - 24x7 [WEB-123]\r\nLOCATION:Room 4\r\nATTENDEE;CN=Jane Doe;PARTSTAT=ACCEPTED:mailto:me@example.com\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"),
+		},
+		"bad_rewrite": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&rw=SUMMARY=Standup",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad rw argument: invalid rewrite parameter "SUMMARY=Standup" at index 0, should be <FIELD>=<regexp>=<replacement>`)),
+		},
+		"privacy_mode": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&prv=Busy",
+			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Meetings),
+			expectedStatus:   http.StatusOK,
+			expectedCalendar: fixtures.MeetingsPrivate,
+		},
+		"privacy_mode_removes_unknown_properties": {
+			inputMethod:      http.MethodGet,
+			inputQuery:       "?cal=http://CALURL&prv=Busy",
 			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
-			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.OutlookMeeting),
 			expectedStatus:   http.StatusOK,
-			expectedCalendar: fixtures.CalOnlyRotation,
+			expectedCalendar: fixtures.OutlookMeetingPrivate,
+			unexpectedInBody: []string{"Secret", "confidential"},
 		},
-		"includeUnsetProperty": {
+		"alarms": {
 			inputMethod:      http.MethodGet,
-			inputQuery:       "?cal=http://CALURL&inc=LOCATION=Rotation",
+			inputQuery:       "?cal=http://CALURL&alarm=-15m&alarm=" + url.QueryEscape("-1d=SUMMARY=shift$"),
 			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
-			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Alarms),
 			expectedStatus:   http.StatusOK,
-			expectedCalendar: fixtures.CalExampleEmpty,
+			expectedCalendar: fixtures.AlarmsAdded,
 		},
-		"excludeSecondary": {
+		"strip_alarms": {
 			inputMethod:      http.MethodGet,
-			inputQuery:       "?cal=http://CALURL&exc=SUMMARY=Secondary",
+			inputQuery:       "?cal=http://CALURL&stripalarms=true&alarm=" + url.QueryEscape("-1h30m=@START=06:00-09:00"),
 			serverOpts:       []server.Opt{server.WithUnsafeClient(&http.Client{})},
-			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.CalExample),
+			upstreamServer:   mockWebcalServer(http.StatusOK, nil, fixtures.Alarms),
 			expectedStatus:   http.StatusOK,
-			expectedCalendar: fixtures.CalWithoutSecondary,
+			expectedCalendar: fixtures.AlarmsReplaced,
+		},
+		"bad_alarm": {
+			inputMethod:    http.MethodGet,
+			inputQuery:     "?cal=http://CALURL&alarm=soon",
+			serverOpts:     []server.Opt{server.WithUnsafeClient(&http.Client{})},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   ptrTo([]byte(`Bad alarm argument: invalid alarm parameter "soon" at index 0, should be <offset>[=<FIELD>=<regexp>] with an offset like -15m, -1h30m, or -1d`)),
 		},
 		"excludeUnsetProperty": {
 			inputMethod:      http.MethodGet,
@@ -416,14 +1022,155 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithEvents,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
+				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
+			},
+		},
+		"htmx_calendar_with_multiple_calendars_one_not_working": {
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL/events", "webcal://CALURL/holidays"},
+			}.Encode()),
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServers(map[string]http.HandlerFunc{"/events": mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024)}),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   daysSept2024WithEvents,
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL/events",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
+				Warnings: []string{"Failed to fetch calendar: webcal://CALURL/holidays"},
+				URL:      "webcal://example.com/?cal=webcal%3A%2F%2FCALURL%2Fevents&cal=webcal%3A%2F%2FCALURL%2Fholidays",
+			},
+		},
+		"htmx_calendar_with_coloured_events": {
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL"},
+				"lbl": []string{""},
+				"cat": []string{""},
+				"col": []string{"green"},
+			}.Encode()),
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   withColor(daysSept2024WithEvents, "green"),
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
+				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL&col=green",
+			},
+		},
+		"htmx_calendar_with_rewritten_events": {
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL"},
+				"rw":  []string{"SUMMARY=^(Picnic)$=$1 in the park"},
+			}.Encode()),
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   withSummary(daysSept2024WithEvents, "Picnic", "Picnic in the park"),
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
 						require.NoError(t, err)
 						return c
 					}(),
+				}},
+				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL&rw=SUMMARY%3D%5E%28Picnic%29%24%3D%241+in+the+park",
+			},
+		},
+		"htmx_calendar_with_recurring_events": {
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL"},
+			}.Encode()),
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServer(http.StatusOK, nil, fixtures.Recurring),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
 				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   daysSept2024WithRecurringEvents,
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Recurring))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -450,14 +1197,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithAllDayEvent,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.AllDayEvent))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -484,14 +1231,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithMultiDayEvent,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.MultiDayEvent))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -520,14 +1267,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithEvents,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/webcal-proxy/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -555,14 +1302,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 12, 9, 0, 0, 0, locSydney),
 				Now:    time.Date(2024, 9, 12, 9, 0, 0, 0, locSydney),
 				Days:   daysSept2024WithEventsSydney,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -666,14 +1413,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithEvents,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -712,6 +1459,94 @@ func TestServer(t *testing.T) {
 				URL:    "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
+		"htmx_calendar_with_events_and_forged_cache": {
+			// if a cache was not signed by the server, fetch the URL and
+			// return a new cache
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL"},
+			}.Encode()),
+			inputCache: &cache.Webcal{
+				URL: "webcal://CALURL",
+				Calendar: func() *ics.Calendar {
+					c, err := ics.ParseCalendar(bytes.NewReader(fixtures.CalExample))
+					require.NoError(t, err)
+					return c
+				}(),
+			},
+			inputCacheKey: []byte("not the server's key"),
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   daysSept2024WithEvents,
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
+				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
+			},
+		},
+		"htmx_calendar_with_events_and_expired_cache": {
+			// if a cache has expired, fetch the URL and return a new cache
+			inputMethod: http.MethodPost,
+			inputHeaders: map[string]string{
+				"X-HX-Host":    "example.com",
+				"Content-Type": "application/x-www-form-urlencoded",
+			},
+			inputBody: []byte(url.Values{
+				"cal": []string{"webcal://CALURL"},
+			}.Encode()),
+			inputCache: &cache.Webcal{
+				URL: "webcal://CALURL",
+				Calendar: func() *ics.Calendar {
+					c, err := ics.ParseCalendar(bytes.NewReader(fixtures.CalExample))
+					require.NoError(t, err)
+					return c
+				}(),
+			},
+			serverOpts: []server.Opt{
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 12, 0, 0, 0, 0, time.UTC) }),
+				server.WithUnsafeClient(&http.Client{}),
+			},
+			upstreamServer:       mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 12, 0, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 12, 0, 0, 0, 0, time.UTC),
+				Days:   daysSept2024WithEvents,
+				Caches: []*cache.Webcal{{
+					URL: "webcal://CALURL",
+					Calendar: func() *ics.Calendar {
+						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
+						require.NoError(t, err)
+						return c
+					}(),
+				}},
+				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
+			},
+		},
 		"htmx_calendar_with_events_and_old_cache": {
 			// if a cached calendar was passed that doesn't match the URL, do
 			// fetch the URL and the new cache
@@ -745,14 +1580,14 @@ func TestServer(t *testing.T) {
 				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
 				Days:   daysSept2024WithEvents,
-				Cache: &cache.Webcal{
+				Caches: []*cache.Webcal{{
 					URL: "webcal://CALURL",
 					Calendar: func() *ics.Calendar {
 						c, err := ics.ParseCalendar(bytes.NewReader(fixtures.Events11Sept2024))
 						require.NoError(t, err)
 						return c
 					}(),
-				},
+				}},
 				URL: "webcal://example.com/?cal=webcal%3A%2F%2FCALURL",
 			},
 		},
@@ -780,34 +1615,88 @@ func TestServer(t *testing.T) {
 				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC) }),
 				server.WithUnsafeClient(&http.Client{}),
 			},
-			expectedStatus:       http.StatusOK,
-			expectedTemplateName: "calendar",
-			expectedTemplateObj: server.Month{
-				View: server.View{
-					ArgHost: "example.com",
-				},
-				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
-				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
-				Days:   daysSeptember2024In(time.UTC),
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "calendar",
+			expectedTemplateObj: server.Month{
+				View: server.View{
+					ArgHost: "example.com",
+				},
+				Target: time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Now:    time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC),
+				Days:   daysSeptember2024In(time.UTC),
+			},
+		},
+		"add_matcher_group": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "matcher",
+			inputHeaders: map[string]string{
+				"X-HX-Host":       "example.com",
+				"X-Forwarded-URI": "/webcal-proxy",
+			},
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "template-matcher-group",
+			expectedTemplateObj: server.View{
+				ArgHost:      "example.com",
+				ArgProxyPath: "/webcal-proxy",
+			},
+		},
+		"remove_matcher_group": {
+			inputMethod: http.MethodDelete,
+			inputQuery:  "matcher",
+			inputHeaders: map[string]string{
+				"X-HX-Host":       "example.com",
+				"X-Forwarded-URI": "/webcal-proxy",
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   ptrTo([]byte(nil)),
+			expectedHeaders: map[string]string{
+				"HX-Trigger-After-Settle": `{"input":{"target":"#trigger-submit"}}`,
+			},
+		},
+		"add_rewrite_group": {
+			inputMethod: http.MethodGet,
+			inputQuery:  "rewrite",
+			inputHeaders: map[string]string{
+				"X-HX-Host":       "example.com",
+				"X-Forwarded-URI": "/webcal-proxy",
+			},
+			expectedStatus:       http.StatusOK,
+			expectedTemplateName: "template-rewrite-group",
+			expectedTemplateObj: server.View{
+				ArgHost:      "example.com",
+				ArgProxyPath: "/webcal-proxy",
+			},
+		},
+		"remove_rewrite_group": {
+			inputMethod: http.MethodDelete,
+			inputQuery:  "rewrite",
+			inputHeaders: map[string]string{
+				"X-HX-Host":       "example.com",
+				"X-Forwarded-URI": "/webcal-proxy",
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   ptrTo([]byte(nil)),
+			expectedHeaders: map[string]string{
+				"HX-Trigger-After-Settle": `{"input":{"target":"#trigger-submit"}}`,
 			},
 		},
-		"add_matcher_group": {
+		"add_source_group": {
 			inputMethod: http.MethodGet,
-			inputQuery:  "matcher",
+			inputQuery:  "source",
 			inputHeaders: map[string]string{
 				"X-HX-Host":       "example.com",
 				"X-Forwarded-URI": "/webcal-proxy",
 			},
 			expectedStatus:       http.StatusOK,
-			expectedTemplateName: "template-matcher-group",
+			expectedTemplateName: "template-source-group",
 			expectedTemplateObj: server.View{
 				ArgHost:      "example.com",
 				ArgProxyPath: "/webcal-proxy",
 			},
 		},
-		"remove_matcher_group": {
+		"remove_source_group": {
 			inputMethod: http.MethodDelete,
-			inputQuery:  "matcher",
+			inputQuery:  "source",
 			inputHeaders: map[string]string{
 				"X-HX-Host":       "example.com",
 				"X-Forwarded-URI": "/webcal-proxy",
@@ -820,7 +1709,7 @@ func TestServer(t *testing.T) {
 		},
 		"pre_fills_the_form_from_url": {
 			inputMethod: http.MethodGet,
-			inputQuery:  "?cal=webcal%3A%2F%2Fyolo.com%2Fevents.ics&inc=SUMMARY%3Dinteresting&inc=SUMMARY%3Dmiddling&exc=DESCRIPTION%3Dboring&mrg=true",
+			inputQuery:  "?cal=webcal%3A%2F%2Fyolo.com%2Fevents.ics&cal=webcal%3A%2F%2Fyolo.com%2Fholidays.ics&cal=&lbl=&lbl=Holiday&col=&col=Green&inc=SUMMARY%3Dinteresting&inc=SUMMARY%3Dmiddling&exc=DESCRIPTION%3Dboring&rw=SUMMARY%3D%5Cs*%5C%5B.*%5C%5D%3D&q=CLASS+%21~+%22PRIVATE%22&tz=Europe%2FLondon&prv=On+call&alarm=-15m&alarm=-1d%3DSUMMARY%3DShift&stripalarms=true&fmt=freebusy&cols=SUMMARY%2CATTENDEE%3BCN&split=true&limit=5&mrg=true&from=-30d&to=2025-01-01",
 			inputHeaders: map[string]string{
 				"Accept": "text/html",
 			},
@@ -831,7 +1720,10 @@ func TestServer(t *testing.T) {
 					ArgHost: "example.com",
 				},
 				Options: server.Options{
-					URL: "webcal://yolo.com/events.ics",
+					Sources: []server.Source{
+						{URL: "webcal://yolo.com/events.ics"},
+						{URL: "webcal://yolo.com/holidays.ics", Label: "Holiday", Color: "green"},
+					},
 					Includes: []server.Matcher{
 						{Property: "SUMMARY", Regex: "interesting"},
 						{Property: "SUMMARY", Regex: "middling"},
@@ -839,7 +1731,24 @@ func TestServer(t *testing.T) {
 					Excludes: []server.Matcher{
 						{Property: "DESCRIPTION", Regex: "boring"},
 					},
-					Merge: true,
+					Rewrites: []server.Rewrite{
+						{Property: "SUMMARY", Regex: `\s*\[.*\]`},
+					},
+					Alarms: []server.Alarm{
+						{Trigger: "-15m"},
+						{Trigger: "-1d", Property: "SUMMARY", Regex: "Shift"},
+					},
+					Query:       `CLASS !~ "PRIVATE"`,
+					Timezone:    "Europe/London",
+					Merge:       true,
+					Private:     "On call",
+					StripAlarms: true,
+					Format:      "freebusy",
+					Columns:     "SUMMARY,ATTENDEE;CN",
+					Split:       true,
+					Limit:       5,
+					From:        "-30d",
+					To:          "2025-01-01",
 				},
 			},
 		},
@@ -937,8 +1846,11 @@ func TestServer(t *testing.T) {
 			inputURL := "/" + strings.Replace(test.inputQuery, "CALURL", upstreamURL.Host, -1)
 			t.Log(inputURL)
 			if calendar, ok := test.expectedTemplateObj.(server.Month); ok {
-				if calendar.Cache != nil {
-					calendar.Cache.URL = strings.Replace(calendar.Cache.URL, "CALURL", upstreamURL.Host, -1)
+				for _, cache := range calendar.Caches {
+					cache.URL = strings.Replace(cache.URL, "CALURL", upstreamURL.Host, -1)
+				}
+				for i, warning := range calendar.Warnings {
+					calendar.Warnings[i] = strings.Replace(warning, "CALURL", upstreamURL.Host, -1)
 				}
 				calendar.URL = strings.Replace(calendar.URL, "CALURL", url.QueryEscape(upstreamURL.Host), -1)
 				test.expectedTemplateObj = calendar
@@ -947,7 +1859,10 @@ func TestServer(t *testing.T) {
 				test.inputCache.URL = strings.Replace(test.inputCache.URL, "CALURL", upstreamURL.Host, -1)
 				q, err := url.ParseQuery(string(test.inputBody))
 				require.NoError(t, err, "test.inputCache must only be used when test.inputBody is application/x-www-form-urlencoded")
-				cache, err := test.inputCache.Encode()
+				if test.inputCacheKey == nil {
+					test.inputCacheKey = testCacheKey
+				}
+				cache, err := test.inputCache.Encode(test.inputCacheKey, testCacheIssued, time.Hour)
 				require.NoError(t, err)
 				q.Set("ical-cache", cache)
 				test.inputBody = []byte(q.Encode())
@@ -971,12 +1886,13 @@ func TestServer(t *testing.T) {
 			}
 
 			router := gin.New()
-			server.New(router, test.serverOpts...)
+			server.New(router, append([]server.Opt{server.CacheKey(testCacheKey)}, test.serverOpts...)...)
 			router.HTMLRender = tpl
 			router.ServeHTTP(w, r)
 
 			assert.Equal(t, test.expectedStatus, w.Code)
 			for k, v := range test.expectedHeaders {
+				v = strings.Replace(v, "CALURL", upstreamURL.Host, -1)
 				require.Equal(t, v, w.Header().Get(k))
 			}
 			if test.expectedCalendar != nil {
@@ -990,6 +1906,12 @@ func TestServer(t *testing.T) {
 			if test.expectedBody != nil {
 				require.Equal(t, *test.expectedBody, w.Body.Bytes())
 			}
+			if test.expectedJSON != nil {
+				assert.JSONEq(t, string(test.expectedJSON), w.Body.String())
+			}
+			for _, unexpected := range test.unexpectedInBody {
+				assert.NotContains(t, w.Body.String(), unexpected)
+			}
 		})
 	}
 }
@@ -1005,6 +1927,15 @@ func mockWebcalServer(code int, headers map[string]string, calendar []byte) http
 	}
 }
 
+// mockWebcalServers routes requests to servers by path.
+func mockWebcalServers(servers map[string]http.HandlerFunc) http.HandlerFunc {
+	mux := http.NewServeMux()
+	for path, server := range servers {
+		mux.Handle(path, server)
+	}
+	return mux.ServeHTTP
+}
+
 type mockTemplate struct {
 	mock.Mock
 }
@@ -1028,3 +1959,727 @@ func (m *mockRender) WriteContentType(w http.ResponseWriter) {
 func ptrTo[T any](t T) *T {
 	return &t
 }
+
+func TestUpstreamCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	for name, test := range map[string]struct {
+		serverOpts        []server.Opt
+		validatorHeaders  map[string]string
+		expectedCondition map[string]string
+		expectedFetches   int
+	}{
+		"etag": {
+			validatorHeaders:  map[string]string{"ETag": `"v1"`},
+			expectedCondition: map[string]string{"If-None-Match": `"v1"`},
+			expectedFetches:   1,
+		},
+		"last_modified": {
+			validatorHeaders:  map[string]string{"Last-Modified": "Wed, 11 Sep 2024 22:44:43 GMT"},
+			expectedCondition: map[string]string{"If-Modified-Since": "Wed, 11 Sep 2024 22:44:43 GMT"},
+			expectedFetches:   1,
+		},
+		"both": {
+			validatorHeaders: map[string]string{
+				"ETag":          `"v1"`,
+				"Last-Modified": "Wed, 11 Sep 2024 22:44:43 GMT",
+			},
+			expectedCondition: map[string]string{
+				"If-None-Match":     `"v1"`,
+				"If-Modified-Since": "Wed, 11 Sep 2024 22:44:43 GMT",
+			},
+			expectedFetches: 1,
+		},
+		"no_validators": {
+			expectedFetches: 3,
+		},
+		"disabled": {
+			serverOpts:       []server.Opt{server.UpstreamCacheSize(0)},
+			validatorHeaders: map[string]string{"ETag": `"v1"`},
+			expectedFetches:  3,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var fetches int
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range test.validatorHeaders {
+					w.Header().Set(k, v)
+				}
+				if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+					for k, v := range test.expectedCondition {
+						assert.Equal(t, v, r.Header.Get(k))
+					}
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fetches++
+				w.Header().Set("Content-Type", "text/calendar")
+				_, _ = w.Write(fixtures.CalUnmerged)
+			}))
+			defer upstreamServer.Close()
+
+			router := gin.New()
+			server.New(router, append(test.serverOpts,
+				server.WithUnsafeClient(&http.Client{}),
+				server.UpstreamMaxAge(0),
+				server.StaleWhileRevalidate(0),
+			)...)
+
+			expectedCalendar, err := ics.ParseCalendar(bytes.NewReader(fixtures.CalMerged))
+			require.NoError(t, err)
+
+			// merging must not modify the cached upstream calendar
+			for range 3 {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?mrg=true&cal="+url.QueryEscape(upstreamServer.URL), nil))
+				require.Equal(t, http.StatusOK, w.Code)
+				require.Equal(t, expectedCalendar.Serialize(), w.Body.String())
+			}
+
+			assert.Equal(t, test.expectedFetches, fetches)
+		})
+	}
+}
+
+func TestUpstreamFetchCoalescing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	var (
+		fetches atomic.Int32
+		release = make(chan struct{})
+	)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "text/calendar")
+		_, _ = w.Write(fixtures.CalExample)
+	}))
+	defer upstreamServer.Close()
+
+	router := gin.New()
+	s := server.New(router, server.WithUnsafeClient(&http.Client{}), server.MaxConns(1))
+	target := "/?cal=" + url.QueryEscape(upstreamServer.URL)
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancelled := httptest.NewRecorder()
+	cancelledDone := make(chan struct{})
+	go func() {
+		defer close(cancelledDone)
+		router.ServeHTTP(cancelled, httptest.NewRequest(http.MethodGet, target, nil).WithContext(cancelledCtx))
+	}()
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(recorders[i], httptest.NewRequest(http.MethodGet, target, nil))
+		}()
+	}
+
+	// a waiter giving up must not cancel the fetch for the others
+	require.Eventually(t, func() bool { return s.InflightWaiters() == len(recorders)+1 }, time.Second, time.Millisecond)
+	cancel()
+	<-cancelledDone
+	assert.Equal(t, http.StatusBadGateway, cancelled.Code)
+
+	close(release)
+	wg.Wait()
+
+	expectedCalendar, err := ics.ParseCalendar(bytes.NewReader(fixtures.CalExample))
+	require.NoError(t, err)
+	for _, w := range recorders {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, expectedCalendar.Serialize(), w.Body.String())
+	}
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestStaleUpstream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	type step struct {
+		advance time.Duration
+		// requests is the number of requests made, one if it is zero.
+		requests         int
+		upstreamStatus   int
+		expectedStatus   int
+		expectedHeaders  map[string]string
+		expectedFetch    bool
+		expectedCalendar []byte
+	}
+
+	for name, test := range map[string]struct {
+		serverOpts      []server.Opt
+		upstreamHeaders map[string]string
+		steps           []step
+	}{
+		"fresh": {
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          30 * time.Second,
+					requests:         5,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "30"},
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+		"upstream_max_age": {
+			upstreamHeaders: map[string]string{"Cache-Control": "public, max-age=3600"},
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          30 * time.Minute,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "1800"},
+					expectedCalendar: fixtures.CalExample,
+				},
+				{
+					advance:          31 * time.Minute,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "3660"},
+					expectedFetch:    true, // in the background
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+		"upstream_expires": {
+			upstreamHeaders: map[string]string{
+				"Date":    "Wed, 11 Sep 2024 23:00:00 GMT",
+				"Expires": "Thu, 12 Sep 2024 00:00:00 GMT",
+			},
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          30 * time.Minute,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "1800"},
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+		"upstream_no_cache": {
+			upstreamHeaders: map[string]string{"Cache-Control": "no-cache"},
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          time.Second,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "1"},
+					expectedFetch:    true, // in the background
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+		"stale_while_revalidate": {
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          2 * time.Minute,
+					requests:         5,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Warning": ""},
+					expectedFetch:    true, // in the background, once
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+		"serve_stale_on_error": {
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          time.Hour,
+					upstreamStatus:   http.StatusInternalServerError,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": "3600", "Warning": `111 - "Revalidation Failed"`},
+					expectedFetch:    true,
+					expectedCalendar: fixtures.CalExample,
+				},
+				{
+					advance:        24 * time.Hour,
+					upstreamStatus: http.StatusInternalServerError,
+					expectedStatus: http.StatusBadGateway,
+					expectedFetch:  true,
+				},
+			},
+		},
+		"max_stale_disabled": {
+			serverOpts: []server.Opt{server.MaxStale(0)},
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:        time.Hour,
+					upstreamStatus: http.StatusInternalServerError,
+					expectedStatus: http.StatusBadGateway,
+					expectedFetch:  true,
+				},
+			},
+		},
+		"stale_while_revalidate_disabled": {
+			serverOpts: []server.Opt{server.StaleWhileRevalidate(0)},
+			steps: []step{
+				{upstreamStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedFetch: true, expectedCalendar: fixtures.CalExample},
+				{
+					advance:          time.Minute,
+					upstreamStatus:   http.StatusOK,
+					expectedStatus:   http.StatusOK,
+					expectedHeaders:  map[string]string{"Age": ""},
+					expectedFetch:    true,
+					expectedCalendar: fixtures.CalExample,
+				},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				upstreamStatus atomic.Int32
+				fetched        = make(chan struct{}, 10)
+			)
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer func() { fetched <- struct{}{} }()
+				for k, v := range test.upstreamHeaders {
+					w.Header().Set(k, v)
+				}
+				w.Header().Set("Content-Type", "text/calendar")
+				w.WriteHeader(int(upstreamStatus.Load()))
+				_, _ = w.Write(fixtures.CalExample)
+			}))
+			defer upstreamServer.Close()
+
+			var now atomic.Pointer[time.Time]
+			now.Store(ptrTo(time.Date(2024, 9, 11, 23, 0, 0, 0, time.UTC)))
+
+			router := gin.New()
+			server.New(router, append(test.serverOpts,
+				server.WithUnsafeClient(&http.Client{}),
+				server.WithClock(func() time.Time { return *now.Load() }),
+			)...)
+
+			for i, step := range test.steps {
+				now.Store(ptrTo(now.Load().Add(step.advance)))
+				upstreamStatus.Store(int32(step.upstreamStatus))
+
+				for range max(step.requests, 1) {
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+
+					require.Equal(t, step.expectedStatus, w.Code, "step %d", i)
+					for k, v := range step.expectedHeaders {
+						assert.Equal(t, v, w.Header().Get(k), "step %d header %s", i, k)
+					}
+					if step.expectedCalendar != nil {
+						expectedCalendar, err := ics.ParseCalendar(bytes.NewReader(step.expectedCalendar))
+						require.NoError(t, err)
+						assert.Equal(t, expectedCalendar.Serialize(), w.Body.String(), "step %d", i)
+					}
+				}
+				if step.expectedFetch {
+					select {
+					case <-fetched:
+					case <-time.After(time.Second):
+						t.Fatalf("step %d did not fetch the upstream", i)
+					}
+				}
+				assert.Empty(t, fetched, "step %d fetched the upstream too many times", i)
+			}
+		})
+	}
+}
+
+func TestFreeBusy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	upstreamServer := httptest.NewServer(mockWebcalServer(http.StatusOK, nil, fixtures.Busy))
+	defer upstreamServer.Close()
+
+	router := gin.New()
+	server.New(router,
+		server.WithUnsafeClient(&http.Client{}),
+		server.WithClock(func() time.Time { return time.Date(2024, 9, 10, 0, 0, 0, 0, time.UTC) }),
+	)
+
+	expectedCalendar, err := ics.ParseCalendar(bytes.NewReader(fixtures.BusyFreeBusy))
+	require.NoError(t, err)
+
+	// the UID depends on the upstream URL, but must be the same every time
+	var uid string
+	for range 2 {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?fmt=freebusy&from=2024-09-09&to=2024-09-11&cal="+url.QueryEscape(upstreamServer.URL), nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/calendar", w.Header().Get("Content-Type"))
+
+		actualCalendar, err := ics.ParseCalendar(w.Body)
+		require.NoError(t, err)
+		require.Len(t, actualCalendar.Busys(), 1)
+		actualUID := actualCalendar.Busys()[0].GetProperty(ics.ComponentPropertyUniqueId)
+		require.NotNil(t, actualUID)
+		if uid == "" {
+			uid = actualUID.Value
+		}
+		assert.Equal(t, uid, actualUID.Value)
+		actualCalendar.Busys()[0].SetProperty(ics.ComponentPropertyUniqueId, "FREEBUSYUID")
+
+		assert.Equal(t, expectedCalendar.Serialize(), actualCalendar.Serialize())
+	}
+}
+
+func TestAtom(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	for name, test := range map[string]struct {
+		inputQuery   string
+		inputHeaders map[string]string
+		expectedFeed []byte
+	}{
+		"fmt": {
+			inputQuery:   "&fmt=atom&tz=Europe%2FLondon",
+			expectedFeed: fixtures.Events11Sept2024Upcoming,
+		},
+		"accept_with_limit": {
+			inputQuery:   "&limit=1",
+			inputHeaders: map[string]string{"Accept": "application/atom+xml"},
+			expectedFeed: []byte(xml.Header + `<feed xmlns="http://www.w3.org/2005/Atom"><id>FEEDID</id><title>webcal-proxy</title><updated>2024-09-11T22:44:43Z</updated><author><name>webcal-proxy</name></author><entry><id>urn:webcal-proxy:event:1726094589133-15391@ical.marudot.com</id><title>Picnic</title><updated>2024-09-11T22:44:43Z</updated><summary>Wed 11 Sep 2024 11:00 UTC&#xA;at Park</summary></entry></feed>`),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			upstreamServer := httptest.NewServer(mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024))
+			defer upstreamServer.Close()
+
+			router := gin.New()
+			server.New(router,
+				server.WithUnsafeClient(&http.Client{}),
+				// the picnic has started but not ended
+				server.WithClock(func() time.Time { return time.Date(2024, 9, 11, 11, 30, 0, 0, time.UTC) }),
+			)
+
+			// the feed ID depends on the upstream URL, but must be the same
+			// every time
+			var feedID string
+			for range 2 {
+				r := httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL)+test.inputQuery, nil)
+				for k, v := range test.inputHeaders {
+					r.Header.Set(k, v)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				require.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "application/atom+xml", w.Header().Get("Content-Type"))
+
+				var feed struct {
+					ID string `xml:"id"`
+				}
+				require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+				require.True(t, strings.HasPrefix(feed.ID, "urn:webcal-proxy:feed:"), feed.ID)
+				if feedID == "" {
+					feedID = feed.ID
+				}
+				assert.Equal(t, feedID, feed.ID)
+
+				assert.Equal(t, string(test.expectedFeed), strings.Replace(w.Body.String(), feed.ID, "FEEDID", 1))
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar")
+		_, _ = w.Write(fixtures.Events11Sept2024)
+	}))
+	defer upstreamServer.Close()
+	upstreamURL, err := url.Parse(upstreamServer.URL)
+	require.NoError(t, err)
+
+	router := gin.New()
+	server.New(router,
+		server.WithUnsafeClient(&http.Client{}),
+		server.UpstreamMaxAge(0),
+		server.StaleWhileRevalidate(0),
+		server.MaxConns(3),
+		server.MetricsPath("/metrics"),
+		server.MetricsHosts(upstreamURL.Hostname()),
+	)
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, expected := range []string{
+		`webcal_proxy_requests_total{code="200",method="GET",route="/"} 2`,
+		`webcal_proxy_requests_total{code="400",method="GET",route="/"} 1`,
+		`webcal_proxy_request_duration_seconds_count{method="GET",route="/"} 3`,
+		`webcal_proxy_upstream_fetch_duration_seconds_count{host="` + upstreamURL.Hostname() + `"} 2`,
+		`webcal_proxy_upstream_response_bytes_total{host="` + upstreamURL.Hostname() + `"} ` + strconv.Itoa(len(fixtures.Events11Sept2024)),
+		`webcal_proxy_upstream_cache_lookups_total{result="miss"} 1`,
+		`webcal_proxy_upstream_cache_lookups_total{result="revalidated"} 1`,
+		`webcal_proxy_upstream_connections_in_use 0`,
+		`webcal_proxy_upstream_connections_max 3`,
+	} {
+		assert.Contains(t, w.Body.String(), expected+"\n")
+	}
+	assert.NotContains(t, w.Body.String(), "webcal_proxy_upstream_fetch_errors_total")
+}
+
+func TestMetricsOtherHosts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	upstreamServer := httptest.NewServer(mockWebcalServer(http.StatusOK, nil, fixtures.Events11Sept2024))
+	defer upstreamServer.Close()
+
+	router := gin.New()
+	s := server.New(router,
+		server.WithUnsafeClient(&http.Client{}),
+		server.MetricsHosts("calendar.example.com"),
+	)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "metrics must not be served on the router by default")
+
+	w = httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `webcal_proxy_upstream_fetch_duration_seconds_count{host="other"} 1`+"\n")
+	assert.NotContains(t, w.Body.String(), `host="127.0.0.1`)
+}
+
+func TestHealth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	var (
+		fetching = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		w.Header().Set("Content-Type", "text/calendar")
+		_, _ = w.Write(fixtures.CalExample)
+	}))
+	defer upstreamServer.Close()
+
+	var now atomic.Pointer[time.Time]
+	now.Store(ptrTo(time.Date(2024, 9, 11, 12, 0, 0, 0, time.UTC)))
+	advance := func(d time.Duration) { now.Store(ptrTo(now.Load().Add(d))) }
+
+	router := gin.New()
+	s := server.New(router,
+		server.WithUnsafeClient(&http.Client{}),
+		server.WithClock(func() time.Time { return *now.Load() }),
+		server.MaxConns(1),
+	)
+
+	assertProbe := func(path string, expectedStatus int, expectedBody string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expectedStatus, w.Code)
+		assert.Equal(t, expectedBody, w.Body.String())
+	}
+
+	assertProbe("/healthz", http.StatusOK, "ok")
+	assertProbe("/readyz", http.StatusOK, "ok")
+
+	// every upstream connection is in use
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}()
+	<-fetching
+	assertProbe("/readyz", http.StatusOK, "ok")
+
+	advance(3 * time.Minute)
+	assertProbe("/healthz", http.StatusOK, "ok")
+	assertProbe("/readyz", http.StatusServiceUnavailable, "upstream connections wedged")
+
+	close(release)
+	<-done
+	assertProbe("/readyz", http.StatusOK, "ok")
+
+	s.Drain()
+	assertProbe("/healthz", http.StatusOK, "ok")
+	assertProbe("/readyz", http.StatusServiceUnavailable, "draining")
+}
+
+func TestClose(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	var (
+		fetching = make(chan struct{})
+		closed   = make(chan struct{})
+	)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		select {
+		case <-r.Context().Done():
+			close(closed)
+		case <-time.After(10 * time.Second):
+			t.Error("upstream request was not cancelled")
+		}
+	}))
+	defer upstreamServer.Close()
+
+	router := gin.New()
+	s := server.New(router, server.WithUnsafeClient(&http.Client{}))
+
+	go func() {
+		<-fetching
+		s.Close()
+	}()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "Failed to fetch calendar", w.Body.String())
+	<-closed
+
+	// nothing can be fetched once closed
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamServer.URL), nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestUpstreamPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+	for name, test := range map[string]struct {
+		inputHost      string
+		inputRedirect  string
+		policy         server.HostPolicy
+		expectedStatus int
+		expectedBody   string
+	}{
+		"private_forbidden_by_default": {
+			inputHost:      "localhost",
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Failed to fetch calendar",
+		},
+		"allow_private": {
+			inputHost:      "localhost",
+			policy:         server.HostPolicy{AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusOK,
+		},
+		"allow_host": {
+			inputHost:      "LocalHost",
+			policy:         server.HostPolicy{Allow: []string{"localhost", "*.example.com"}, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusOK,
+		},
+		"not_allowed_host": {
+			inputHost:      "localhost",
+			policy:         server.HostPolicy{Allow: []string{".example.com"}, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Calendars from localhost can't be fetched by this server.",
+		},
+		"denied_host": {
+			inputHost:      "localhost",
+			policy:         server.HostPolicy{Deny: []string{"local*"}, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Calendars from localhost can't be fetched by this server.",
+		},
+		"denied_address": {
+			inputHost:      "127.0.0.1",
+			policy:         server.HostPolicy{DenyCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Calendars from 127.0.0.1 can't be fetched by this server.",
+		},
+		"denied_address_when_dialling": {
+			// the host name is only resolved when dialling
+			inputHost:      "localhost",
+			policy:         server.HostPolicy{DenyCIDRs: loopback, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Failed to fetch calendar",
+		},
+		"public_address_not_allowed": {
+			inputHost:      "203.0.113.7",
+			policy:         server.HostPolicy{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}},
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "Calendars from 203.0.113.7 can't be fetched by this server.",
+		},
+		"redirect_to_denied_host": {
+			inputHost:      "127.0.0.1",
+			inputRedirect:  "localhost",
+			policy:         server.HostPolicy{Allow: []string{"127.0.0.1"}, AllowPrivateCIDRs: loopback},
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "Failed to fetch calendar",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.inputRedirect != "" && r.URL.Path != "/redirected" {
+					_, port, _ := net.SplitHostPort(r.Host)
+					http.Redirect(w, r, "http://"+net.JoinHostPort(test.inputRedirect, port)+"/redirected", http.StatusFound)
+					return
+				}
+				w.Header().Set("Content-Type", "text/calendar")
+				_, _ = w.Write(fixtures.CalExample)
+			}))
+			defer upstreamServer.Close()
+			upstreamURL, err := url.Parse(upstreamServer.URL)
+			require.NoError(t, err)
+			upstreamURL.Host = test.inputHost + ":" + upstreamURL.Port()
+
+			router := gin.New()
+			server.New(router, server.UpstreamPolicy(test.policy))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?cal="+url.QueryEscape(upstreamURL.String()), nil))
+			assert.Equal(t, test.expectedStatus, w.Code)
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
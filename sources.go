@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Source is an upstream calendar and how its events are labelled.
+type Source struct {
+	URL, Label, Category, Color string
+}
+
+type source struct {
+	url string
+	// label prefixes the summary of every event.
+	label string
+	// category is added to the categories of every event.
+	category string
+	// color is a CSS colour name set as the colour of every event.
+	color string
+}
+
+func (s source) Source() Source {
+	return Source{
+		URL:      s.url,
+		Label:    s.label,
+		Category: s.category,
+		Color:    s.color,
+	}
+}
+
+// getSources returns the non-empty cal values without duplicates. The nth lbl,
+// cat, and col values label the events of the nth cal value.
+func getSources(ctx context.Context, getArray func(string) []string) ([]source, error) {
+	var (
+		urls       = getArray("cal")
+		labels     = getArray("lbl")
+		categories = getArray("cat")
+		colors     = getArray("col")
+		sources    []source
+	)
+	for i, url := range urls {
+		if url == "" || slices.ContainsFunc(sources, func(s source) bool { return s.url == url }) {
+			continue
+		}
+
+		src := source{
+			url:      url,
+			label:    getIndex(labels, i),
+			category: getIndex(categories, i),
+			color:    strings.ToLower(getIndex(colors, i)),
+		}
+		if src.color != "" && !cssColorNames[src.color] {
+			log(ctx).Warnf("invalid colour %q", src.color)
+			return nil, newErrorWithMessage(
+				http.StatusBadRequest,
+				"Bad argument %q for \"col\", should be a CSS colour name.", src.color,
+			)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func getIndex(ss []string, i int) string {
+	if i >= len(ss) {
+		return ""
+	}
+	return ss[i]
+}
+
+// sourceURLs returns the URL of each source.
+func sourceURLs(sources []source) []string {
+	urls := make([]string, len(sources))
+	for i, src := range sources {
+		urls[i] = src.url
+	}
+	return urls
+}
+
+// sourcesID returns an ID that is the same for every request for the same
+// sources, without revealing them.
+func sourcesID(sources []source) string {
+	sum := sha256.Sum256([]byte(strings.Join(sourceURLs(sources), "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sourceValues returns the query values for sources. The lbl, cat, and col
+// values are only included if any source uses them.
+func sourceValues(sources []source) url.Values {
+	q := url.Values{
+		"cal": sourceURLs(sources),
+	}
+	for key, get := range map[string]func(source) string{
+		"lbl": func(s source) string { return s.label },
+		"cat": func(s source) string { return s.category },
+		"col": func(s source) string { return s.color },
+	} {
+		if !slices.ContainsFunc(sources, func(s source) bool { return get(s) != "" }) {
+			continue
+		}
+		for _, src := range sources {
+			q.Add(key, get(src))
+		}
+	}
+	return q
+}
+
+func (s source) labelled() bool {
+	return s.label != "" || s.category != "" || s.color != ""
+}
+
+// labelEvents sets the source's label, category, and colour on every event in
+// calendar.
+func (s source) labelEvents(calendar *ics.Calendar) {
+	if !s.labelled() {
+		return
+	}
+
+	for _, event := range calendar.Events() {
+		if s.label != "" {
+			summary := s.label
+			if property := event.GetProperty(ics.ComponentPropertySummary); property != nil {
+				summary += " " + property.Value
+			}
+			event.SetSummary(summary)
+		}
+		if s.category != "" {
+			event.AddProperty(ics.ComponentPropertyCategories, s.category)
+		}
+		if s.color != "" {
+			event.SetColor(s.color)
+		}
+	}
+}
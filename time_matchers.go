@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Time based pseudo-properties that can be matched like iCal event properties.
+const (
+	// propertyWeekday matches a regexp against the weekday the event starts
+	// on, eg Monday.
+	propertyWeekday = "@WEEKDAY"
+	// propertyStart matches events that start in a range of times of day, eg
+	// 09:00-17:00. The range wraps at midnight if it ends before it starts.
+	propertyStart = "@START"
+	// propertyEnd matches events that end in a range of times of day.
+	propertyEnd = "@END"
+	// propertyDuration matches events whose duration is in a range, eg
+	// 15m-1h, <15m, or >1h.
+	propertyDuration = "@DURATION"
+)
+
+// timeMatcher matches the start, end, or duration of events in a time zone.
+type timeMatcher struct {
+	property string
+	// value is the argument the matcher was parsed from.
+	value string
+	// loc is the time zone that floating and all day times are in.
+	loc   *time.Location
+	match func(start, end time.Time) bool
+}
+
+func isTimeProperty(property ics.ComponentProperty) bool {
+	return strings.HasPrefix(string(property), "@")
+}
+
+// parseTimeMatcher parses the value of a time based pseudo-property, times are
+// evaluated in loc.
+func parseTimeMatcher(property ics.ComponentProperty, value string, loc *time.Location) (timeMatcher, error) {
+	m := timeMatcher{
+		property: string(property),
+		value:    value,
+		loc:      loc,
+	}
+	switch m.property {
+	case propertyWeekday:
+		expression, err := regexp.Compile(value)
+		if err != nil {
+			return timeMatcher{}, fmt.Errorf("bad regexp: %w", err)
+		}
+		m.match = func(start, _ time.Time) bool {
+			return expression.MatchString(start.In(loc).Weekday().String())
+		}
+	case propertyStart:
+		from, to, err := parseTimeOfDayRange(value)
+		if err != nil {
+			return timeMatcher{}, err
+		}
+		m.match = func(start, _ time.Time) bool {
+			t := timeOfDay(start.In(loc))
+			if from <= to {
+				return from <= t && t < to
+			}
+			return from <= t || t < to
+		}
+	case propertyEnd:
+		from, to, err := parseTimeOfDayRange(value)
+		if err != nil {
+			return timeMatcher{}, err
+		}
+		m.match = func(_, end time.Time) bool {
+			t := timeOfDay(end.In(loc))
+			if from <= to {
+				return from < t && t <= to
+			}
+			return from < t || t <= to
+		}
+	case propertyDuration:
+		inRange, err := parseDurationRange(value)
+		if err != nil {
+			return timeMatcher{}, err
+		}
+		m.match = func(start, end time.Time) bool {
+			return inRange(end.Sub(start))
+		}
+	default:
+		return timeMatcher{}, fmt.Errorf("unknown field %s, should be one of %s, %s, %s, or %s", property, propertyWeekday, propertyStart, propertyEnd, propertyDuration)
+	}
+	return m, nil
+}
+
+// parseTimeOfDayRange parses a range of times of day like 09:00-17:00.
+func parseTimeOfDayRange(value string) (time.Duration, time.Duration, error) {
+	badRange := fmt.Errorf("bad time range %q, should be like 09:00-17:00", value)
+	fromValue, toValue, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, badRange
+	}
+	from, err := time.Parse("15:04", fromValue)
+	if err != nil {
+		return 0, 0, badRange
+	}
+	to, err := time.Parse("15:04", toValue)
+	if err != nil {
+		return 0, 0, badRange
+	}
+	return timeOfDay(from), timeOfDay(to), nil
+}
+
+// parseDurationRange parses a range of durations like 15m-1h, <15m, or >1h
+// and returns whether a duration is in it. The lower bound of 15m-1h is
+// inclusive.
+func parseDurationRange(value string) (func(time.Duration) bool, error) {
+	badRange := fmt.Errorf("bad duration range %q, should be like 15m-1h, <15m, or >1h", value)
+	switch {
+	case strings.HasPrefix(value, "<"):
+		shorter, err := time.ParseDuration(value[1:])
+		if err != nil {
+			return nil, badRange
+		}
+		return func(d time.Duration) bool { return d < shorter }, nil
+	case strings.HasPrefix(value, ">"):
+		longer, err := time.ParseDuration(value[1:])
+		if err != nil {
+			return nil, badRange
+		}
+		return func(d time.Duration) bool { return d > longer }, nil
+	}
+
+	fromValue, toValue, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, badRange
+	}
+	from, err := time.ParseDuration(fromValue)
+	if err != nil {
+		return nil, badRange
+	}
+	to, err := time.ParseDuration(toValue)
+	if err != nil {
+		return nil, badRange
+	}
+	return func(d time.Duration) bool { return from <= d && d < to }, nil
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// matches returns true if the event's times match, events without a start
+// never match. Events without an end are treated as having no duration.
+// Floating and all day times are parsed in time.Local, they are moved to the
+// matcher's time zone without changing their clock time.
+func (m timeMatcher) matches(event *ics.VEvent) bool {
+	start, err := event.GetStartAt()
+	if err != nil {
+		return false
+	}
+	if start.Location() == time.Local {
+		start = setLocation(start, m.loc)
+	}
+	end, err := event.GetEndAt()
+	if err != nil || end.Before(start) {
+		end = start
+	} else if end.Location() == time.Local {
+		end = setLocation(end, m.loc)
+	}
+	return m.match(start, end)
+}
+
+func (m timeMatcher) String() string {
+	return m.property + " =~ " + quoteQuery(m.value)
+}
+
+func (m timeMatcher) Matcher() Matcher {
+	return Matcher{
+		Property: m.property,
+		Regex:    m.value,
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const (
+	defaultUpstreamCacheSize    = 64
+	defaultUpstreamMaxAge       = time.Minute
+	defaultStaleWhileRevalidate = 5 * time.Minute
+	defaultMaxStale             = 24 * time.Hour
+)
+
+// upstreamEntry is a parsed upstream calendar and the validators needed to
+// revalidate it. The calendar is shared between requests and must not be
+// modified.
+type upstreamEntry struct {
+	url          string
+	calendar     *ics.Calendar
+	etag         string
+	lastModified string
+	// fetched is when the calendar was last fetched or revalidated.
+	fetched time.Time
+	// maxAge is how long after fetched the calendar is fresh and can be used
+	// without revalidating it.
+	maxAge time.Duration
+}
+
+// upstreamCache is a least recently used cache of upstream calendars keyed by
+// their normalised URL.
+type upstreamCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newUpstreamCache(size int) *upstreamCache {
+	return &upstreamCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *upstreamCache) get(url string) (upstreamEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return upstreamEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(upstreamEntry), true
+}
+
+func (c *upstreamCache) put(entry upstreamEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size < 1 {
+		return
+	}
+
+	if elem, ok := c.entries[entry.url]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.url] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(upstreamEntry).url)
+	}
+}
+
+// upstreamMaxAge returns how long an upstream response is fresh for, from its
+// Cache-Control or Expires header, or def if it has neither. A response that
+// must be revalidated or has an invalid Expires header is not fresh at all.
+func upstreamMaxAge(header http.Header, now time.Time, def time.Duration) time.Duration {
+	var (
+		maxAge    time.Duration
+		hasMaxAge bool
+	)
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			maxAge, hasMaxAge = time.Duration(seconds)*time.Second, true
+		}
+	}
+	if hasMaxAge {
+		return maxAge
+	}
+
+	if header.Get("Expires") == "" {
+		return def
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	return max(expires.Sub(date), 0)
+}
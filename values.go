@@ -0,0 +1,245 @@
+package server
+
+import (
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// Value types are written as iCal text in the ics library, jCal and xCal
+// write dates, times, and UTC offsets in the extended format of ISO 8601.
+// These helpers convert between the two.
+
+// valueTypeUnknown is the value type of experimental properties whose type
+// isn't given.
+const valueTypeUnknown ics.ValueDataType = "UNKNOWN"
+
+// componentName returns the iCal name of component, eg VEVENT.
+func componentName(component ics.Component) string {
+	switch c := component.(type) {
+	case *ics.VEvent:
+		return "VEVENT"
+	case *ics.VTodo:
+		return "VTODO"
+	case *ics.VJournal:
+		return "VJOURNAL"
+	case *ics.VBusy:
+		return "VFREEBUSY"
+	case *ics.VTimezone:
+		return "VTIMEZONE"
+	case *ics.VAlarm:
+		return "VALARM"
+	case *ics.Standard:
+		return "STANDARD"
+	case *ics.Daylight:
+		return "DAYLIGHT"
+	case *ics.GeneralComponent:
+		return c.Token
+	}
+	return "X-UNKNOWN"
+}
+
+// newComponent returns a component of the named type, eg VEVENT.
+func newComponent(name string, base ics.ComponentBase) ics.Component {
+	switch strings.ToUpper(name) {
+	case "VEVENT":
+		return &ics.VEvent{ComponentBase: base}
+	case "VTODO":
+		return &ics.VTodo{ComponentBase: base}
+	case "VJOURNAL":
+		return &ics.VJournal{ComponentBase: base}
+	case "VFREEBUSY":
+		return &ics.VBusy{ComponentBase: base}
+	case "VTIMEZONE":
+		return &ics.VTimezone{ComponentBase: base}
+	case "VALARM":
+		return &ics.VAlarm{ComponentBase: base}
+	case "STANDARD":
+		return &ics.Standard{ComponentBase: base}
+	case "DAYLIGHT":
+		return &ics.Daylight{ComponentBase: base}
+	}
+	return &ics.GeneralComponent{ComponentBase: base, Token: strings.ToUpper(name)}
+}
+
+// multiValuedProperties are text properties whose values are comma
+// separated lists.
+var multiValuedProperties = []string{
+	string(ics.PropertyCategories),
+	string(ics.PropertyResources),
+}
+
+// valueType returns the value type of property, which is unknown for
+// experimental properties without a VALUE parameter.
+func valueType(property ics.BaseProperty) ics.ValueDataType {
+	if _, ok := property.ICalParameters[string(ics.ParameterValue)]; !ok &&
+		strings.HasPrefix(strings.ToUpper(property.IANAToken), "X-") {
+		return valueTypeUnknown
+	}
+	return property.GetValueType()
+}
+
+// isDate returns true if property is a date rather than a date-time, either by
+// its VALUE parameter or, as some calendars leave that out, by its value being
+// a date like 20240911.
+func isDate(property ics.BaseProperty) bool {
+	if property.GetValueType() == ics.ValueDataTypeDate {
+		return true
+	}
+	return len(property.Value) == 8 && strings.Trim(property.Value, "0123456789") == ""
+}
+
+// defaultValueType returns the value type of a property named name when it
+// has no VALUE parameter.
+func defaultValueType(name string) ics.ValueDataType {
+	return valueType(ics.BaseProperty{IANAToken: strings.ToUpper(name)})
+}
+
+// setValueType gives property a VALUE parameter if valueType isn't the
+// default for its name.
+func setValueType(property *ics.BaseProperty, valueType ics.ValueDataType) {
+	if valueType != "" && valueType != valueTypeUnknown && valueType != defaultValueType(property.IANAToken) {
+		property.ICalParameters[string(ics.ParameterValue)] = []string{string(valueType)}
+	}
+}
+
+// splitValues returns the values of property, which is a comma separated list
+// for some properties and value types.
+func splitValues(property ics.BaseProperty, valueType ics.ValueDataType) []string {
+	switch {
+	case valueType == ics.ValueDataTypeText && containsFold(multiValuedProperties, property.IANAToken),
+		valueType == ics.ValueDataTypeDate,
+		valueType == ics.ValueDataTypeDateTime,
+		valueType == ics.ValueDataTypePeriod:
+		return strings.Split(property.Value, ",")
+	}
+	return []string{property.Value}
+}
+
+// extendedValue converts a date, time, date-time, or UTC offset from iCal's
+// basic format to the extended format, eg 20240911T100000Z to
+// 2024-09-11T10:00:00Z. Other values are returned as they are.
+func extendedValue(valueType ics.ValueDataType, value string) string {
+	switch valueType {
+	case ics.ValueDataTypeDate:
+		return extendedDate(value)
+	case ics.ValueDataTypeDateTime:
+		return extendedDateTime(value)
+	case ics.ValueDataTypeTime:
+		return extendedTime(value)
+	case ics.ValueDataTypeUtcOffset:
+		if len(value) == 5 || len(value) == 7 {
+			return value[:3] + ":" + value[3:5] + strings.TrimSuffix(":"+value[5:], ":")
+		}
+	}
+	return value
+}
+
+// extendedDate converts a date like 20240911 to 2024-09-11.
+func extendedDate(value string) string {
+	if len(value) != 8 {
+		return value
+	}
+	return value[:4] + "-" + value[4:6] + "-" + value[6:]
+}
+
+// extendedTime converts a time like 100000Z to 10:00:00Z.
+func extendedTime(value string) string {
+	if len(value) < 6 {
+		return value
+	}
+	return value[:2] + ":" + value[2:4] + ":" + value[4:]
+}
+
+// extendedDateTime converts a date-time like 20240911T100000Z to
+// 2024-09-11T10:00:00Z.
+func extendedDateTime(value string) string {
+	date, t, ok := strings.Cut(value, "T")
+	if !ok {
+		return extendedDate(value)
+	}
+	return extendedDate(date) + "T" + extendedTime(t)
+}
+
+// basicValue converts a value from the extended format to iCal's basic
+// format, it is the reverse of extendedValue.
+func basicValue(valueType ics.ValueDataType, value string) string {
+	switch valueType {
+	case ics.ValueDataTypeDate, ics.ValueDataTypeDateTime:
+		date, t, hasTime := strings.Cut(value, "T")
+		value = strings.ReplaceAll(date, "-", "")
+		if hasTime {
+			value += "T" + strings.ReplaceAll(t, ":", "")
+		}
+	case ics.ValueDataTypeTime, ics.ValueDataTypeUtcOffset:
+		value = strings.ReplaceAll(value, ":", "")
+	}
+	return value
+}
+
+// splitPeriod splits a period into its start and either its end or its
+// duration.
+func splitPeriod(value string) (start, end string, isDuration, ok bool) {
+	start, end, ok = strings.Cut(value, "/")
+	return start, end, strings.HasPrefix(strings.TrimLeft(end, "+-"), "P"), ok
+}
+
+// recurIntegerParts are the parts of a recurrence rule that have integer
+// values.
+var recurIntegerParts = []string{
+	"COUNT", "INTERVAL", "BYSECOND", "BYMINUTE", "BYHOUR", "BYMONTHDAY",
+	"BYYEARDAY", "BYWEEKNO", "BYMONTH", "BYSETPOS",
+}
+
+// recurPart is one part of a recurrence rule, eg BYDAY=MO,WE.
+type recurPart struct {
+	name   string
+	values []string
+}
+
+// splitRecur splits a recurrence rule like FREQ=WEEKLY;BYDAY=MO,WE into its
+// parts, in order. UNTIL is converted to the extended format.
+func splitRecur(value string) []recurPart {
+	var parts []recurPart
+	for _, part := range strings.Split(value, ";") {
+		name, partValue, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToUpper(name)
+		values := strings.Split(partValue, ",")
+		if name == "UNTIL" {
+			for i, v := range values {
+				values[i] = extendedDateTime(v)
+			}
+		}
+		parts = append(parts, recurPart{name: name, values: values})
+	}
+	return parts
+}
+
+// joinRecur joins parts into a recurrence rule, it is the reverse of
+// splitRecur.
+func joinRecur(parts []recurPart) string {
+	rule := make([]string, 0, len(parts))
+	for _, part := range parts {
+		values := part.values
+		if part.name == "UNTIL" {
+			values = make([]string, len(part.values))
+			for i, v := range part.values {
+				values[i] = basicValue(ics.ValueDataTypeDateTime, v)
+			}
+		}
+		rule = append(rule, part.name+"="+strings.Join(values, ","))
+	}
+	return strings.Join(rule, ";")
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
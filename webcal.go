@@ -2,16 +2,23 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	ics "github.com/arran4/golang-ical"
 	"github.com/brackendawson/webcal-proxy/cache"
+	"github.com/gin-gonic/gin"
 )
 
-func parseURLScheme(ctx context.Context, addr string) (string, error) {
+func parseURLScheme(ctx context.Context, addr string, policy HostPolicy) (string, error) {
 	addrURL, err := url.Parse(addr)
 	if err != nil {
 		log(ctx).Warnf("invalid calendar url: %s", err)
@@ -32,73 +39,373 @@ func parseURLScheme(ctx context.Context, addr string) (string, error) {
 		)
 	}
 
+	if !policy.allowsURLHost(addrURL.Hostname()) {
+		log(ctx).Warnf("Forbidden calendar host %q", addrURL.Hostname())
+		return "", newErrorWithMessage(
+			http.StatusForbidden,
+			"Calendars from %s can't be fetched by this server.",
+			addrURL.Hostname(),
+		)
+	}
+
+	// Normalise the URL so that it can be used as an upstream cache key.
+	addrURL.Host = strings.ToLower(addrURL.Host)
+	addrURL.Fragment = ""
+	addrURL.RawFragment = ""
+
 	return addrURL.String(), nil
 }
 
-func (s *Server) getUpstreamCalendar(ctx context.Context, url string) (*ics.Calendar, error) {
-	upstreamURL, err := parseURLScheme(ctx, url)
+// encodeCache encodes c for the browser to send back with its next request.
+func (s *Server) encodeCache(c *cache.Webcal) (string, error) {
+	return c.Encode(s.cacheKey, s.now(), s.cacheMaxAge)
+}
+
+// upstreamCalendar is an upstream calendar and how fresh it is.
+type upstreamCalendar struct {
+	// source is the calendar's source as given by the user.
+	source   source
+	calendar *ics.Calendar
+	// err is why the calendar could not be fetched, if it couldn't.
+	err error
+	// cache is the browser's cache that the calendar came from, or nil.
+	cache *cache.Webcal
+	// age is how long ago the calendar was last fetched or revalidated, it is
+	// zero if the calendar was fetched for this request.
+	age time.Duration
+	// stale is true if the calendar could not be revalidated and a cached copy
+	// was used instead.
+	stale bool
+}
+
+func (s *Server) getUpstreamCalendar(ctx context.Context, url string) (upstreamCalendar, error) {
+	upstreamURL, err := parseURLScheme(ctx, url, s.policy)
 	if err != nil {
-		return nil, err
+		return upstreamCalendar{}, err
 	}
 
-	upstream, err := s.fetch(upstreamURL)
+	cached, isCached := s.upstreamCache.get(upstreamURL)
+	age := s.now().Sub(cached.fetched)
+	if isCached && age < cached.maxAge {
+		log(ctx).Debugf("Using fresh cached calendar %q from %s ago.", upstreamURL, age)
+		s.metrics.upstreamCache.WithLabelValues(cacheHit).Inc()
+		return upstreamCalendar{
+			calendar: cached.calendar,
+			age:      age,
+		}, nil
+	}
+	if isCached && age < cached.maxAge+s.staleWhileRevalidate {
+		log(ctx).Debugf("Using cached calendar %q from %s ago, revalidating in background.", upstreamURL, age)
+		s.metrics.upstreamCache.WithLabelValues(cacheHit).Inc()
+		go s.revalidate(context.WithoutCancel(ctx), upstreamURL, cached.fetched)
+		return upstreamCalendar{
+			calendar: cached.calendar,
+			age:      age,
+		}, nil
+	}
+
+	upstream, err := s.inflight.do(ctx, upstreamURL, func(ctx context.Context) (*ics.Calendar, error) {
+		return s.fetch(ctx, upstreamURL)
+	})
 	if err != nil {
 		log(ctx).Warnf("Failed to fetch calendar %q: %s", upstreamURL, err)
-		return nil, newErrorWithMessage(
+		if isCached && age <= s.maxStale {
+			log(ctx).Warnf("Using stale calendar %q from %s ago.", upstreamURL, age)
+			s.metrics.upstreamCache.WithLabelValues(cacheStale).Inc()
+			return upstreamCalendar{
+				calendar: cached.calendar,
+				age:      age,
+				stale:    true,
+			}, nil
+		}
+		s.metrics.upstreamCache.WithLabelValues(cacheMiss).Inc()
+		var msgErr errorWithMessage
+		if errors.As(err, &msgErr) {
+			return upstreamCalendar{}, msgErr
+		}
+		return upstreamCalendar{}, newErrorWithMessage(
 			http.StatusBadGateway,
 			"Failed to fetch calendar",
 		)
 	}
 
-	return upstream, nil
+	if isCached && upstream == cached.calendar {
+		s.metrics.upstreamCache.WithLabelValues(cacheRevalidated).Inc()
+	} else {
+		s.metrics.upstreamCache.WithLabelValues(cacheMiss).Inc()
+	}
+	return upstreamCalendar{calendar: upstream}, nil
 }
 
-func decodeCache(ctx context.Context, upstreamURL string, rawCache string) (*ics.Calendar, bool) {
-	if rawCache == "" {
-		return nil, false
+// revalidate refreshes the cached copy of upstreamURL that was fetched at
+// fetched. Concurrent revalidations share one fetch and the calendar is not
+// fetched again if another request has already refreshed it.
+func (s *Server) revalidate(ctx context.Context, upstreamURL string, fetched time.Time) {
+	if _, err := s.inflight.do(ctx, upstreamURL, func(ctx context.Context) (*ics.Calendar, error) {
+		if cached, ok := s.upstreamCache.get(upstreamURL); ok && !cached.fetched.Equal(fetched) {
+			return cached.calendar, nil
+		}
+		return s.fetch(ctx, upstreamURL)
+	}); err != nil {
+		log(ctx).Warnf("Failed to revalidate calendar %q: %s", upstreamURL, err)
 	}
-	cache, err := cache.ParseWebcal(rawCache)
-	if err != nil {
-		log(ctx).Warnf("Failed to parse cache: %s. Continuing without.")
-		return nil, false
+}
+
+// getUpstreamCalendars gets the calendar for each source in parallel, using the
+// browser's rawCaches where possible. Calendars that could not be fetched have
+// err set, an error is only returned if a url is invalid or if no calendar
+// could be fetched.
+func (s *Server) getUpstreamCalendars(ctx context.Context, sources []source, rawCaches []string) ([]upstreamCalendar, error) {
+	for _, src := range sources {
+		if _, err := parseURLScheme(ctx, src.url, s.policy); err != nil {
+			return nil, err
+		}
 	}
 
-	if cache.URL != upstreamURL {
-		log(ctx).Debugf("Cache was for old URL %q, ignoring.", cache.URL)
-		return nil, false
+	caches := s.decodeCaches(ctx, rawCaches)
+
+	var (
+		upstreams = make([]upstreamCalendar, len(sources))
+		wg        sync.WaitGroup
+	)
+	for i, src := range sources {
+		cache, ok := caches[src.url]
+		if len(rawCaches) > 0 {
+			result := cacheMiss
+			if ok {
+				result = cacheHit
+			}
+			s.metrics.browserCache.WithLabelValues(result).Inc()
+		}
+		if ok {
+			log(ctx).Debugf("Using cached calendar %q", src.url)
+			upstreams[i] = upstreamCalendar{
+				source:   src,
+				calendar: cache.Calendar,
+				cache:    &cache,
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			upstream, err := s.getUpstreamCalendar(ctx, src.url)
+			upstream.source = src
+			upstream.err = err
+			upstreams[i] = upstream
+		}()
 	}
+	wg.Wait()
 
-	log(ctx).Debug("Using cached calendar")
-	return cache.Calendar, true
+	for _, upstream := range upstreams {
+		if upstream.err == nil {
+			return upstreams, nil
+		}
+	}
+	return nil, upstreams[0].err
 }
 
-func (s *Server) getUpstreamWithCache(ctx context.Context, upstreamURL string, rawCache string) (_ *ics.Calendar, usedCache bool, _ error) {
-	upstream, ok := decodeCache(ctx, upstreamURL, rawCache)
-	if !ok {
-		upstream, err := s.getUpstreamCalendar(ctx, upstreamURL)
-		if err != nil {
-			return nil, false, err
+// combineCalendars combines calendars into one. Events that share a UID with an
+// event in an earlier calendar are dropped. The calendar properties are taken
+// from the first calendar.
+func combineCalendars(calendars []*ics.Calendar) *ics.Calendar {
+	if len(calendars) == 1 {
+		return calendars[0]
+	}
+
+	combined := &ics.Calendar{
+		CalendarProperties: calendars[0].CalendarProperties,
+	}
+	var (
+		seenEvents    = make(map[string]bool)
+		seenTimezones = make(map[string]bool)
+	)
+	for _, calendar := range calendars {
+		events := make(map[string]bool)
+		for _, component := range calendar.Components {
+			switch component := component.(type) {
+			case *ics.VEvent:
+				if id := eventID(component); id != "" {
+					if seenEvents[id] {
+						continue
+					}
+					events[id] = true
+				}
+			case *ics.VTimezone:
+				if tzid := component.GetProperty(ics.ComponentPropertyTzid); tzid != nil {
+					if seenTimezones[tzid.Value] {
+						continue
+					}
+					seenTimezones[tzid.Value] = true
+				}
+			}
+			combined.Components = append(combined.Components, component)
+		}
+		// a calendar may hold several events with the same UID as
+		// recurrence overrides, so only de-duplicate across calendars
+		maps.Copy(seenEvents, events)
+	}
+
+	return combined
+}
+
+// eventID returns an event's UID and RECURRENCE-ID, or empty string if it has
+// no UID.
+func eventID(event *ics.VEvent) string {
+	uid := event.GetProperty(ics.ComponentPropertyUniqueId)
+	if uid == nil || uid.Value == "" {
+		return ""
+	}
+	id := uid.Value
+	if recurrenceID := event.GetProperty(ics.ComponentProperty(ics.PropertyRecurrenceId)); recurrenceID != nil {
+		id += "/" + recurrenceID.Value
+	}
+	return id
+}
+
+// setUpstreamHeaders tells the client how fresh the upstream calendars are and
+// which could not be fetched.
+func setUpstreamHeaders(c *gin.Context, upstreams []upstreamCalendar) {
+	var age time.Duration
+	for _, upstream := range upstreams {
+		age = max(age, upstream.age)
+		if upstream.err != nil {
+			c.Writer.Header().Add("Warning", fmt.Sprintf("199 - %q", "Failed to fetch calendar "+upstream.source.url))
 		}
+		if upstream.stale {
+			c.Writer.Header().Add("Warning", `111 - "Revalidation Failed"`)
+		}
+	}
+	if age > 0 {
+		c.Header("Age", strconv.Itoa(int(age.Seconds())))
+	}
+}
 
-		return upstream, false, nil
+// upstreamWarnings describes the problems with upstreams for the user.
+func upstreamWarnings(upstreams []upstreamCalendar) []string {
+	var warnings []string
+	for _, upstream := range upstreams {
+		var msgErr errorWithMessage
+		switch {
+		case errors.As(upstream.err, &msgErr):
+			warnings = append(warnings, fmt.Sprintf("%s: %s", msgErr.message, upstream.source.url))
+		case upstream.err != nil:
+			warnings = append(warnings, fmt.Sprintf("%s: %s", http.StatusText(http.StatusInternalServerError), upstream.source.url))
+		case upstream.stale:
+			warnings = append(warnings, fmt.Sprintf("Failed to refresh calendar, showing a copy from %s ago: %s", upstream.age.Round(time.Second), upstream.source.url))
+		}
 	}
+	return warnings
+}
 
-	return upstream, true, nil
+// browserCaches returns the upstream calendars for the browser to cache, or nil
+// if the browser's cache is still current.
+func browserCaches(upstreams []upstreamCalendar) []*cache.Webcal {
+	var (
+		caches  []*cache.Webcal
+		changed bool
+	)
+	for _, upstream := range upstreams {
+		switch {
+		case upstream.err != nil:
+		case upstream.cache != nil:
+			caches = append(caches, upstream.cache)
+		default:
+			changed = true
+			caches = append(caches, &cache.Webcal{
+				URL:      upstream.source.url,
+				Calendar: upstream.calendar,
+			})
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return caches
 }
 
-// fetch fetches the given url from the given IP address
-func (s *Server) fetch(url string) (*ics.Calendar, error) {
-	s.semaphore <- struct{}{}
-	defer func() { <-s.semaphore }()
+// decodeCaches returns the valid caches in rawCaches by URL.
+func (s *Server) decodeCaches(ctx context.Context, rawCaches []string) map[string]cache.Webcal {
+	caches := make(map[string]cache.Webcal, len(rawCaches))
+	for _, rawCache := range rawCaches {
+		if rawCache == "" {
+			continue
+		}
+		cache, err := cache.ParseWebcal(rawCache, s.cacheKey, s.now(), s.cacheMaxAge)
+		if err != nil {
+			log(ctx).Warnf("Failed to parse cache: %s. Continuing without.", err)
+			continue
+		}
+		caches[cache.URL] = cache
+	}
+	return caches
+}
 
-	upstream, err := s.client.Get(url)
+// fetch fetches the given url, revalidating any cached copy of it.
+func (s *Server) fetch(ctx context.Context, url string) (_ *ics.Calendar, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(s.closed, cancel)()
+
+	if err := s.takeConn(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseConn()
+
+	start := time.Now()
+	var upstreamRead oddometer
+	defer func() {
+		s.metrics.observeFetch(url, time.Since(start), upstreamRead.bytes, err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", upstreamAccept)
+
+	cached, isCached := s.upstreamCache.get(url)
+	if isCached {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	upstream, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer upstream.Body.Close()
+	if isCached && upstream.StatusCode == http.StatusNotModified {
+		log(ctx).Debugf("Upstream calendar %q not modified, using cache.", url)
+		cached.fetched = s.now()
+		cached.maxAge = upstreamMaxAge(upstream.Header, cached.fetched, s.upstreamMaxAge)
+		s.upstreamCache.put(cached)
+		return cached.calendar, nil
+	}
 	if upstream.StatusCode < 200 || upstream.StatusCode >= 300 {
 		return nil, fmt.Errorf("bad status: %s", upstream.Status)
 	}
 
-	return ics.ParseCalendar(upstream.Body)
+	upstreamRead.ReadCloser = upstream.Body
+	calendar, err := parseCalendar(upstream.Header.Get("Content-Type"), &upstreamRead)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := upstreamEntry{
+		url:          url,
+		calendar:     calendar,
+		etag:         upstream.Header.Get("ETag"),
+		lastModified: upstream.Header.Get("Last-Modified"),
+		fetched:      s.now(),
+	}
+	entry.maxAge = upstreamMaxAge(upstream.Header, entry.fetched, s.upstreamMaxAge)
+	s.upstreamCache.put(entry)
+
+	return calendar, nil
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+// relativeTime matches a number of days or weeks relative to now. A leading
+// space is a + that wasn't escaped in the URL's query.
+var relativeTime = regexp.MustCompile(`^([+ -]?)(\d+)([dw])$`)
+
+// window is the range of time that events must overlap to be included.
+type window struct {
+	// from and to are the arguments the window was parsed from.
+	from, to string
+	// start and end bound the window, they are zero if it is unbounded.
+	start, end time.Time
+}
+
+// getWindow returns the window given by the from and to values. Each may be a
+// date, a time, or a number of days or weeks relative to now.
+func getWindow(ctx context.Context, getArray func(string) []string, now time.Time) (window, error) {
+	var (
+		w   window
+		err error
+	)
+	w.from, w.start, err = getTime(ctx, getArray, "from", now)
+	if err != nil {
+		return window{}, err
+	}
+	w.to, w.end, err = getTime(ctx, getArray, "to", now)
+	if err != nil {
+		return window{}, err
+	}
+	return w, nil
+}
+
+func getTime(ctx context.Context, getArray func(string) []string, key string, now time.Time) (string, time.Time, error) {
+	ts := getArray(key)
+	if len(ts) < 1 || ts[0] == "" {
+		return "", time.Time{}, nil
+	}
+
+	t, err := parseTime(ts[0], now)
+	if err != nil {
+		log(ctx).Warnf("error getting %q parameter: %s", key, err)
+		return "", time.Time{}, newErrorWithMessage(
+			http.StatusBadRequest,
+			"Bad argument %q for %q, should be a date like 2024-09-11 or a number of days from now like -30d.", ts[0], key,
+		)
+	}
+
+	return ts[0], t, nil
+}
+
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if parts := relativeTime.FindStringSubmatch(value); parts != nil {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if parts[1] == "-" {
+			n = -n
+		}
+		if parts[3] == "w" {
+			n *= 7
+		}
+		return now.AddDate(0, 0, n), nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateOnly, value, now.Location()); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// horizon returns the window, using from and to where it is unbounded.
+func (w window) horizon(from, to time.Time) (time.Time, time.Time) {
+	if !w.start.IsZero() {
+		from = w.start
+	}
+	if !w.end.IsZero() {
+		to = w.end
+	}
+	return from, to
+}
+
+// contains returns true if the event overlaps the window. Events with no start
+// are always in the window.
+func (w window) contains(event *ics.VEvent) bool {
+	start, err := event.GetStartAt()
+	if err != nil {
+		return true
+	}
+	end, err := eventEnd(event)
+	if err != nil || end.Before(start) {
+		end = start
+	}
+
+	if !w.start.IsZero() && !end.After(w.start) && !start.Equal(w.start) {
+		return false
+	}
+	if !w.end.IsZero() && !start.Before(w.end) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const xCalNamespace = "urn:ietf:params:xml:ns:icalendar-2.0"
+
+// xmlNode is any XML element, it is used to read and write xCal.
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+func xmlElement(name string, children ...xmlNode) xmlNode {
+	return xmlNode{XMLName: xml.Name{Local: name}, Children: children}
+}
+
+func xmlText(name, text string) xmlNode {
+	return xmlNode{XMLName: xml.Name{Local: name}, Text: text}
+}
+
+// child returns the first child element named name.
+func (n xmlNode) child(name string) (xmlNode, bool) {
+	for _, child := range n.Children {
+		if child.XMLName.Local == name {
+			return child, true
+		}
+	}
+	return xmlNode{}, false
+}
+
+// writeXCal writes calendar in the xCal format of RFC 6321.
+func writeXCal(w io.Writer, calendar *ics.Calendar) error {
+	properties := make([]ics.IANAProperty, len(calendar.CalendarProperties))
+	for i, property := range calendar.CalendarProperties {
+		properties[i] = ics.IANAProperty{BaseProperty: property.BaseProperty}
+	}
+	root := xmlElement("icalendar", xCalComponent("vcalendar", properties, calendar.Components))
+	// The namespace is declared with an attribute because the encoder would
+	// put elements without a namespace outside of it if it were in the name.
+	root.Attrs = []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: xCalNamespace}}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(root)
+}
+
+func xCalComponent(name string, properties []ics.IANAProperty, components []ics.Component) xmlNode {
+	xProperties := xmlElement("properties")
+	for _, property := range properties {
+		xProperties.Children = append(xProperties.Children, xCalProperty(property.BaseProperty))
+	}
+	node := xmlElement(strings.ToLower(name), xProperties)
+
+	if len(components) > 0 {
+		xComponents := xmlElement("components")
+		for _, component := range components {
+			xComponents.Children = append(xComponents.Children, xCalComponent(
+				componentName(component),
+				component.UnknownPropertiesIANAProperties(),
+				component.SubComponents(),
+			))
+		}
+		node.Children = append(node.Children, xComponents)
+	}
+	return node
+}
+
+// parameterValueTypes are the value types of parameters that aren't text.
+var parameterValueTypes = map[string]ics.ValueDataType{
+	string(ics.ParameterAltrep):        ics.ValueDataTypeUri,
+	string(ics.ParameterDir):           ics.ValueDataTypeUri,
+	string(ics.ParameterDelegatedFrom): ics.ValueDataTypeCalAddress,
+	string(ics.ParameterDelegatedTo):   ics.ValueDataTypeCalAddress,
+	string(ics.ParameterMember):        ics.ValueDataTypeCalAddress,
+	string(ics.ParameterSentBy):        ics.ValueDataTypeCalAddress,
+}
+
+func parameterValueType(name string) ics.ValueDataType {
+	if valueType, ok := parameterValueTypes[strings.ToUpper(name)]; ok {
+		return valueType
+	}
+	return ics.ValueDataTypeText
+}
+
+func xCalProperty(property ics.BaseProperty) xmlNode {
+	node := xmlElement(strings.ToLower(property.IANAToken))
+
+	var keys []string
+	for key := range property.ICalParameters {
+		if !strings.EqualFold(key, string(ics.ParameterValue)) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		slices.Sort(keys)
+		parameters := xmlElement("parameters")
+		for _, key := range keys {
+			parameter := xmlElement(strings.ToLower(key))
+			valueName := strings.ToLower(string(parameterValueType(key)))
+			for _, value := range property.ICalParameters[key] {
+				parameter.Children = append(parameter.Children, xmlText(valueName, value))
+			}
+			parameters.Children = append(parameters.Children, parameter)
+		}
+		node.Children = append(node.Children, parameters)
+	}
+
+	valueType := valueType(property)
+	valueName := strings.ToLower(string(valueType))
+	switch {
+	case strings.EqualFold(property.IANAToken, string(ics.PropertyGeo)):
+		latitude, longitude, _ := strings.Cut(property.Value, ";")
+		node.Children = append(node.Children, xmlText("latitude", latitude), xmlText("longitude", longitude))
+	case valueType == ics.ValueDataTypeRecur:
+		recur := xmlElement(valueName)
+		for _, part := range splitRecur(property.Value) {
+			for _, value := range part.values {
+				recur.Children = append(recur.Children, xmlText(strings.ToLower(part.name), value))
+			}
+		}
+		node.Children = append(node.Children, recur)
+	case valueType == ics.ValueDataTypePeriod:
+		for _, value := range splitValues(property, valueType) {
+			start, end, isDuration, ok := splitPeriod(value)
+			if !ok {
+				node.Children = append(node.Children, xmlText(valueName, value))
+				continue
+			}
+			endNode := xmlText("end", extendedDateTime(end))
+			if isDuration {
+				endNode = xmlText("duration", end)
+			}
+			node.Children = append(node.Children, xmlElement(valueName, xmlText("start", extendedDateTime(start)), endNode))
+		}
+	default:
+		for _, value := range splitValues(property, valueType) {
+			node.Children = append(node.Children, xmlText(valueName, extendedValue(valueType, value)))
+		}
+	}
+	return node
+}
+
+// parseXCal parses a calendar in the xCal format of RFC 6321. Only the first
+// vcalendar is used.
+func parseXCal(r io.Reader) (*ics.Calendar, error) {
+	var root xmlNode
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "icalendar" {
+		return nil, errors.New("xCal has no icalendar element")
+	}
+	vcalendar, ok := root.child("vcalendar")
+	if !ok {
+		return nil, errors.New("xCal has no vcalendar element")
+	}
+
+	base := parseXCalComponent(vcalendar)
+	calendar := &ics.Calendar{
+		Components: base.Components,
+	}
+	for _, property := range base.Properties {
+		calendar.CalendarProperties = append(calendar.CalendarProperties, ics.CalendarProperty{BaseProperty: property.BaseProperty})
+	}
+	return calendar, nil
+}
+
+func parseXCalComponent(node xmlNode) ics.ComponentBase {
+	var base ics.ComponentBase
+	if properties, ok := node.child("properties"); ok {
+		for _, property := range properties.Children {
+			base.Properties = append(base.Properties, ics.IANAProperty{BaseProperty: parseXCalProperty(property)})
+		}
+	}
+	if components, ok := node.child("components"); ok {
+		for _, component := range components.Children {
+			base.Components = append(base.Components, newComponent(component.XMLName.Local, parseXCalComponent(component)))
+		}
+	}
+	return base
+}
+
+func parseXCalProperty(node xmlNode) ics.BaseProperty {
+	property := ics.BaseProperty{
+		IANAToken:      strings.ToUpper(node.XMLName.Local),
+		ICalParameters: map[string][]string{},
+	}
+
+	var (
+		valueType ics.ValueDataType
+		values    []string
+		geo       [2]string
+	)
+	for _, child := range node.Children {
+		switch name := child.XMLName.Local; name {
+		case "parameters":
+			for _, parameter := range child.Children {
+				key := strings.ToUpper(parameter.XMLName.Local)
+				for _, value := range parameter.Children {
+					property.ICalParameters[key] = append(property.ICalParameters[key], value.Text)
+				}
+			}
+		case "latitude":
+			valueType, geo[0] = ics.ValueDataTypeFloat, child.Text
+		case "longitude":
+			valueType, geo[1] = ics.ValueDataTypeFloat, child.Text
+		case "recur":
+			valueType = ics.ValueDataTypeRecur
+			var parts []recurPart
+			for _, part := range child.Children {
+				partName := strings.ToUpper(part.XMLName.Local)
+				if len(parts) > 0 && parts[len(parts)-1].name == partName {
+					parts[len(parts)-1].values = append(parts[len(parts)-1].values, part.Text)
+					continue
+				}
+				parts = append(parts, recurPart{name: partName, values: []string{part.Text}})
+			}
+			values = append(values, joinRecur(parts))
+		case "period":
+			valueType = ics.ValueDataTypePeriod
+			start, _ := child.child("start")
+			value := basicValue(ics.ValueDataTypeDateTime, start.Text)
+			if end, ok := child.child("end"); ok {
+				value += "/" + basicValue(ics.ValueDataTypeDateTime, end.Text)
+			} else if duration, ok := child.child("duration"); ok {
+				value += "/" + duration.Text
+			}
+			values = append(values, value)
+		default:
+			valueType = ics.ValueDataType(strings.ToUpper(name))
+			values = append(values, basicValue(valueType, child.Text))
+		}
+	}
+
+	if geo != [2]string{} {
+		values = append(values, geo[0]+";"+geo[1])
+	}
+	property.Value = strings.Join(values, ",")
+	setValueType(&property, valueType)
+	return property
+}